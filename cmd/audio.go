@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	audioHop     = 20   // ms per envelope frame
+	audioHistory = 50   // frames of history a beat is compared against, 1s
+	audioMinBeat = 250  // ms between beats at most 240 bpm
+	audioRest    = 2000 // ms between beats after which the stroke rests
+	audioVibrate = 100  // ms between vibrate actions
+)
+
+// AudioOptions describe raw PCM input, which has no header, and how eager
+// beat detection is. WAV input carries its own rate and channels.
+type AudioOptions struct {
+	Rate        int
+	Channels    int
+	Sensitivity float64 // energy over the recent average that makes a beat
+}
+
+var defaultAudioOptions = AudioOptions{
+	Rate:        44100,
+	Channels:    2,
+	Sensitivity: 1.4,
+}
+
+// AudioAnalysis is the energy envelope of a track, one normalized (0-1) rms
+// value per audioHop ms, and the beats found in it in ms.
+type AudioAnalysis struct {
+	Envelope []float64
+	Beats    []int
+}
+
+// readAudio decodes a WAV file, or signed 16 bit little endian PCM if it has
+// no RIFF header, to its energy per audioHop ms. "-" reads stdin so audio can
+// be piped in from ffmpeg.
+func readAudio(path string, opts AudioOptions) ([]float64, error) {
+	var r io.Reader = os.Stdin
+
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audio: %w", err)
+		}
+
+		defer f.Close()
+
+		r = f
+	}
+
+	br := bufio.NewReader(r)
+
+	header, err := br.Peek(4)
+	if err == nil && string(header) == "RIFF" {
+		return readWAV(br)
+	}
+
+	return decodePCM(br, 1, 16, opts.Channels, opts.Rate)
+}
+
+// readWAV reads the fmt and data chunks of a WAV stream. A data chunk with
+// an unknown size, as written to a pipe, is read to the end.
+func readWAV(r io.Reader) ([]float64, error) {
+	var riff struct {
+		ID   [4]byte
+		Size uint32
+		Wave [4]byte
+	}
+
+	err := binary.Read(r, binary.LittleEndian, &riff)
+	if err != nil || string(riff.Wave[:]) != "WAVE" {
+		return nil, errors.New("not a wav file")
+	}
+
+	var (
+		format   uint16
+		channels int
+		rate     int
+		bits     int
+	)
+
+	for {
+		var chunk struct {
+			ID   [4]byte
+			Size uint32
+		}
+
+		err = binary.Read(r, binary.LittleEndian, &chunk)
+		if err != nil {
+			return nil, fmt.Errorf("wav has no data chunk: %w", err)
+		}
+
+		switch string(chunk.ID[:]) {
+		case "fmt ":
+			buf := make([]byte, chunk.Size+chunk.Size%2)
+
+			_, err = io.ReadFull(r, buf)
+			if err != nil || len(buf) < 16 {
+				return nil, fmt.Errorf("invalid wav fmt chunk: %w", err)
+			}
+
+			format = binary.LittleEndian.Uint16(buf[0:])
+			channels = int(binary.LittleEndian.Uint16(buf[2:]))
+			rate = int(binary.LittleEndian.Uint32(buf[4:]))
+			bits = int(binary.LittleEndian.Uint16(buf[14:]))
+
+			// WAVE_FORMAT_EXTENSIBLE keeps the real format in its sub format
+			if format == 0xfffe && len(buf) >= 26 {
+				format = binary.LittleEndian.Uint16(buf[24:])
+			}
+		case "data":
+			if rate == 0 {
+				return nil, errors.New("wav data before fmt chunk")
+			}
+
+			data := r
+			if chunk.Size != math.MaxUint32 && chunk.Size != 0 {
+				data = io.LimitReader(r, int64(chunk.Size))
+			}
+
+			return decodePCM(data, format, bits, channels, rate)
+		default:
+			_, err = io.CopyN(io.Discard, r, int64(chunk.Size+chunk.Size%2))
+			if err != nil {
+				return nil, fmt.Errorf("failed to skip wav chunk: %w", err)
+			}
+		}
+	}
+}
+
+// decodePCM streams interleaved integer (format 1) or float (format 3)
+// samples, mixes them down to mono in -1 to 1 and returns the mean energy of
+// every audioHop ms. Only the energy is kept, a whole track of samples
+// doesn't fit in memory.
+func decodePCM(r io.Reader, format uint16, bits, channels, rate int) ([]float64, error) {
+	if channels <= 0 {
+		return nil, fmt.Errorf("invalid channel count %d", channels)
+	}
+
+	if rate <= 0 {
+		return nil, fmt.Errorf("invalid sample rate %d", rate)
+	}
+
+	size := bits / 8
+
+	switch {
+	case format == 1 && (bits == 8 || bits == 16 || bits == 24 || bits == 32):
+	case format == 3 && (bits == 32 || bits == 64):
+	default:
+		return nil, fmt.Errorf("unsupported audio format %d with %d bit samples", format, bits)
+	}
+
+	frame := size * channels
+	hop := max(1, rate*audioHop/1000)
+
+	buf := make([]byte, frame*hop)
+	energy := []float64{}
+
+	for {
+		n, err := io.ReadFull(r, buf)
+
+		frames := n / frame
+		if frames > 0 {
+			sum := 0.0
+
+			for i := 0; i < frames*frame; i += frame {
+				mono := 0.0
+
+				for c := 0; c < channels; c++ {
+					mono += decodeSample(buf[i+c*size:], format, bits)
+				}
+
+				mono /= float64(channels)
+				sum += mono * mono
+			}
+
+			energy = append(energy, sum/float64(frames))
+		}
+
+		switch {
+		case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+			return energy, nil
+		case err != nil:
+			return nil, fmt.Errorf("failed to read audio: %w", err)
+		}
+	}
+}
+
+func decodeSample(b []byte, format uint16, bits int) float64 {
+	switch {
+	case format == 3 && bits == 32:
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+	case format == 3:
+		return math.Float64frombits(binary.LittleEndian.Uint64(b))
+	case bits == 8:
+		return (float64(b[0]) - 128) / 128 // 8 bit wav is unsigned
+	case bits == 16:
+		return float64(int16(binary.LittleEndian.Uint16(b))) / (1 << 15)
+	case bits == 24:
+		return float64(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24)>>8) / (1 << 23)
+	default:
+		return float64(int32(binary.LittleEndian.Uint32(b))) / (1 << 31)
+	}
+}
+
+// analyzeAudio computes the envelope from the energy of each audioHop ms and
+// marks a beat wherever a frame's energy jumps over sensitivity times the
+// average of the second before it.
+func analyzeAudio(energy []float64, sensitivity float64) AudioAnalysis {
+	a := AudioAnalysis{
+		Envelope: make([]float64, len(energy)),
+		Beats:    []int{},
+	}
+
+	peak := 0.0
+	for _, e := range energy {
+		peak = math.Max(peak, e)
+	}
+
+	if peak == 0 {
+		return a // silence
+	}
+
+	history := 0.0
+
+	for i, e := range energy {
+		a.Envelope[i] = math.Sqrt(e / peak)
+
+		if i >= audioHistory {
+			history -= energy[i-audioHistory]
+		}
+
+		n := min(i, audioHistory)
+		at := i * audioHop
+
+		quiet := e < peak*1e-3
+		recent := len(a.Beats) > 0 && at-a.Beats[len(a.Beats)-1] < audioMinBeat
+
+		if n > 0 && !quiet && !recent && e > sensitivity*history/float64(n) {
+			a.Beats = append(a.Beats, at)
+		}
+
+		history += e
+	}
+
+	return a
+}
+
+// level is the envelope at ms.
+func (a AudioAnalysis) level(ms int) float64 {
+	i := ms / audioHop
+	if i < 0 || i >= len(a.Envelope) {
+		return 0
+	}
+
+	return a.Envelope[i]
+}
+
+// StrokeActions go down on every beat, deeper the louder the beat, and back
+// up between beats. Long gaps rest at the top. Close beats get shallower
+// strokes so no move is faster than maxLintSpeed.
+func (a AudioAnalysis) StrokeActions() []FunscriptAction {
+	actions := []FunscriptAction{{At: 0, Pos: 100}}
+
+	for i, beat := range a.Beats {
+		next := beat + audioRest
+		if i+1 < len(a.Beats) {
+			next = a.Beats[i+1]
+		}
+
+		up := beat + (next-beat)/2
+		if next-beat >= audioRest {
+			up = min(beat+audioRest/4, len(a.Envelope)*audioHop) // rest before the track ends
+		}
+
+		// the stroke goes down from the last action and back up by up
+		gap := min(beat-actions[len(actions)-1].At, up-beat)
+		depth := math.Min(100*(0.4+0.6*a.level(beat)), maxLintSpeed*float64(gap)/1000)
+
+		actions = append(actions,
+			FunscriptAction{At: beat, Pos: 100 - int(math.Floor(depth))},
+			FunscriptAction{At: up, Pos: 100},
+		)
+	}
+
+	return actions
+}
+
+// VibrateActions follow the loudness of the track.
+func (a AudioAnalysis) VibrateActions() []FunscriptAction {
+	actions := []FunscriptAction{}
+	step := audioVibrate / audioHop
+
+	for i := 0; i < len(a.Envelope); i += step {
+		level := 0.0
+		for _, l := range a.Envelope[i:min(i+step, len(a.Envelope))] {
+			level = math.Max(level, l)
+		}
+
+		actions = append(actions, FunscriptAction{At: i * audioHop, Pos: clampPos(100 * level)})
+	}
+
+	return append(actions, FunscriptAction{At: len(a.Envelope) * audioHop, Pos: 0})
+}
+
+// audioScripts turns a track into a stroke and a vibrate script.
+func audioScripts(path string, opts AudioOptions) ([]*Script, error) {
+	energy, err := readAudio(path, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(energy) == 0 {
+		return nil, errors.New("no audio samples")
+	}
+
+	a := analyzeAudio(energy, opts.Sensitivity)
+
+	log.Info().
+		Int("beats", len(a.Beats)).
+		Dur("length", time.Duration(len(a.Envelope)*audioHop)*time.Millisecond).
+		Msgf("analyzed %s", path)
+
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	scripts := []*Script{}
+
+	for _, axis := range []string{defaultAxis, "vibrate"} {
+		s := axisMap[axis]
+
+		script := &Script{
+			path:      "audio:" + path,
+			name:      axis,
+			filename:  name,
+			base:      name,
+			generated: true,
+			Axis:      s.Axis,
+			Channel:   s.Channel,
+			Duration:  len(a.Envelope) * audioHop,
+			Range:     100,
+		}
+
+		if axis == defaultAxis {
+			script.Actions = a.StrokeActions()
+		} else {
+			script.Actions = a.VibrateActions()
+		}
+
+		scripts = append(scripts, script)
+	}
+
+	return scripts, nil
+}
+
+// LoadAudio replaces the loaded scripts with ones generated from an audio
+// track.
+func (s *Scripts) LoadAudio(path string, opts AudioOptions) error {
+	scripts, err := audioScripts(path, opts)
+	if err != nil {
+		return err
+	}
+
+	s.Reset()
+
+	for _, script := range scripts {
+		s.variants[script.name] = []*Script{script}
+		s.scripts[script.name] = script
+	}
+
+	return nil
+}
+
+// saveAudioScripts writes the scripts generated from a track next to each
+// other, the stroke to out and the vibrate to out with a .vibrate suffix.
+func saveAudioScripts(w io.Writer, path, out string, opts AudioOptions) error {
+	scripts, err := audioScripts(path, opts)
+	if err != nil {
+		return err
+	}
+
+	for _, script := range scripts {
+		p := out
+		if script.name != defaultAxis {
+			p = strings.TrimSuffix(out, ".funscript") + "." + script.name + ".funscript"
+		}
+
+		err = writeScript(p, script)
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(w, "wrote %s: %d actions\n", p, len(script.Actions))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
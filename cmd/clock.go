@@ -0,0 +1,222 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ClockConfig tunes how the playback clock follows the host. Corrections
+// smaller than Deadband are ignored, ones larger than Snap jump straight to
+// the reported position (a seek), everything in between is slewed in at
+// Slew seconds per second. Jumps of more than Ramp move the device to the
+// new position at RampSpeed units/s before playback goes on, 0 turns that
+// off; a Ramp below Snap snaps from Ramp on so those jumps are ramped too.
+// Deadband, Snap and Ramp are in ms.
+type ClockConfig struct {
+	Deadband  int     `json:"deadband"`
+	Snap      int     `json:"snap"`
+	Slew      float64 `json:"slew"`
+	Ramp      int     `json:"ramp"`
+	RampSpeed float64 `json:"rampSpeed"`
+}
+
+var defaultClockConfig = ClockConfig{
+	Deadband:  15,
+	Snap:      1000,
+	Slew:      0.1,
+	Ramp:      500,
+	RampSpeed: 200,
+}
+
+// snap is the drift in ms from which Sync jumps rather than slews.
+func (c ClockConfig) snap() int {
+	if c.Ramp > 0 && c.RampSpeed > 0 {
+		return min(c.Snap, c.Ramp)
+	}
+
+	return c.Snap
+}
+
+// DriftStats describe how far the clock was from the host's reports, in ms.
+type DriftStats struct {
+	Syncs   int     `json:"syncs"`
+	Ignored int     `json:"ignored"`
+	Slewed  int     `json:"slewed"`
+	Snapped int     `json:"snapped"`
+	Last    float64 `json:"last"`
+	Mean    float64 `json:"mean"` // of the absolute drift, snaps excluded
+	Max     float64 `json:"max"`  // snaps excluded
+	RMS     float64 `json:"rms"`  // snaps excluded
+
+	sumAbs, sumSquares float64
+}
+
+func (s *DriftStats) add(drift float64) {
+	s.Last = drift
+	s.sumAbs += math.Abs(drift)
+	s.sumSquares += drift * drift
+
+	n := float64(s.Ignored + s.Slewed)
+	s.Mean = s.sumAbs / n
+	s.RMS = math.Sqrt(s.sumSquares / n)
+	s.Max = math.Max(s.Max, math.Abs(drift))
+}
+
+// Clock is the playback position. It runs on the monotonic clock from the
+// last position it was given rather than counting ticks, so ticker jitter
+// and GC pauses don't add up, and it eases into the host's corrections
+// instead of jumping. Rate scales it for slow motion and fast forward.
+type Clock struct {
+	mu sync.Mutex
+
+	base    time.Duration // position at anchor
+	anchor  time.Time
+	running bool
+	rate    float64
+
+	// pending is the correction still being slewed in since anchor
+	pending time.Duration
+
+	// jump is the distance of the last seek or snap not yet taken
+	jump   time.Duration
+	jumped bool
+
+	stats DriftStats
+}
+
+func NewClock(rate float64) *Clock {
+	return &Clock{anchor: time.Now(), rate: rate}
+}
+
+// position is the clock at now, the caller holds mu.
+func (c *Clock) position(now time.Time) time.Duration {
+	if !c.running {
+		return c.base
+	}
+
+	elapsed := now.Sub(c.anchor)
+	pos := c.base + time.Duration(float64(elapsed)*c.rate)
+
+	slew := time.Duration(float64(elapsed) * params.Load().Clock.Slew)
+	if c.pending > 0 {
+		pos += min(c.pending, slew)
+	} else {
+		pos += max(c.pending, -slew)
+	}
+
+	return pos
+}
+
+func (c *Clock) Position() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.position(time.Now())
+}
+
+// Set jumps to pos.
+func (c *Clock) Set(pos time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.jump, c.jumped = pos-c.position(now), true
+	c.base, c.anchor, c.pending = pos, now, 0
+}
+
+// Sync corrects the clock towards a position reported by the host.
+func (c *Clock) Sync(pos time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cfg := params.Load().Clock
+	now := time.Now()
+	current := c.position(now)
+	drift := pos - current
+	ms := float64(drift) / float64(time.Millisecond)
+	abs := math.Abs(ms)
+
+	c.stats.Syncs++
+
+	switch {
+	case !c.running || abs > float64(cfg.snap()):
+		c.stats.Snapped++
+		c.jump, c.jumped = drift, true
+		c.base, c.anchor, c.pending = pos, now, 0
+
+		log.Trace().Float64("drift", ms).Msg("clock snapped")
+
+		return
+	case abs < float64(cfg.Deadband):
+		c.stats.Ignored++
+	default:
+		c.stats.Slewed++
+
+		// restart the slew from here, the new drift already includes
+		// whatever was left of the last one
+		c.base, c.anchor, c.pending = current, now, drift
+	}
+
+	c.stats.add(ms)
+
+	log.Trace().Float64("drift", ms).Msg("clock sync")
+}
+
+func (c *Clock) Pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.base, c.anchor, c.pending = c.position(now), now, 0
+	c.running = false
+}
+
+func (c *Clock) Resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.running {
+		return
+	}
+
+	c.anchor = time.Now()
+	c.running = true
+}
+
+// Jumped returns the distance of the last seek or snap, once.
+func (c *Clock) Jumped() (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	jumped := c.jumped
+	c.jumped = false
+
+	return c.jump, jumped
+}
+
+// SetRate changes the playback rate from now on.
+func (c *Clock) SetRate(rate float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.base, c.anchor, c.pending = c.position(now), now, 0
+	c.rate = rate
+}
+
+func (c *Clock) Rate() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.rate
+}
+
+func (c *Clock) Stats() DriftStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.stats
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const (
+	defaultDevicePath = "/dev/cu.usbserial-0001"
+	defaultBaudRate   = 115200
+
+	// deviceAuto makes portDevice.open probe the candidate serial ports
+	// instead of opening a fixed path.
+	deviceAuto = "auto"
+)
+
+type Config struct {
+	Device string `json:"device"`
+	Baud   uint   `json:"baud"`
+
+	// Devices replaces Device/Baud when several devices are driven at once.
+	Devices []DeviceConfig `json:"devices"`
+
+	// Trace is where the virtual device dumps its position trace on exit.
+	Trace string `json:"trace"`
+
+	// Generators enables and tunes the axis generators, keyed by axis name
+	// (twist) or tcode id (R0).
+	Generators map[string]Generator `json:"generators"`
+
+	// Pattern is decoded over the default pattern, unset fields keep their
+	// defaults.
+	Pattern Pattern `json:"pattern"`
+
+	// Clock thresholds are decoded over the defaults like Pattern.
+	Clock ClockConfig `json:"clock"`
+
+	// Limits cap axis velocity and acceleration on everything sent to the
+	// devices, decoded over the defaults like Pattern.
+	Limits LimitConfig `json:"limits"`
+
+	// Watchdog is how long in ms listen keeps playing without hearing from
+	// the host, 0 turns it off.
+	Watchdog int `json:"watchdog"`
+}
+
+var config = Config{
+	Device: defaultDevicePath,
+	Baud:   defaultBaudRate,
+
+	Pattern: defaultPattern,
+
+	Clock: defaultClockConfig,
+
+	Limits: defaultLimitConfig,
+
+	Watchdog: defaultWatchdog,
+}
+
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, "tcode-player", "config.json")
+}
+
+// loadConfig reads a json config file on top of the defaults. A missing file
+// is only an error when the path was given explicitly.
+func loadConfig(path string, explicit bool) error {
+	if path == "" {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if !explicit && errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+
+		return fmt.Errorf("failed to open config: %w", err)
+	}
+
+	defer f.Close()
+
+	err = json.NewDecoder(f).Decode(&config)
+	if err != nil {
+		return fmt.Errorf("failed to decode config: %w", err)
+	}
+
+	return nil
+}
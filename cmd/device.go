@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var errNotConnected = errors.New("device not connected")
+
+// resendInterval is how long the device gets to move back to the last sent
+// position after a reconnect.
+const resendInterval = time.Second
+
+// reconnectInterval is how long the reconnect loop waits before its first
+// attempt. It backs off from there up to reconnectMax.
+var reconnectInterval = time.Second
+
+const reconnectMax = 30 * time.Second
+
+// DeviceState is the connection state machine:
+//
+//	disconnected -> connecting -> connected
+//	                     |            |
+//	                     v            v
+//	                   failed -> connecting (reconnect loop)
+type DeviceState int
+
+const (
+	DeviceDisconnected DeviceState = iota
+	DeviceConnecting
+	DeviceConnected
+	DeviceFailed
+)
+
+func (s DeviceState) String() string {
+	switch s {
+	case DeviceDisconnected:
+		return "disconnected"
+	case DeviceConnecting:
+		return "connecting"
+	case DeviceConnected:
+		return "connected"
+	case DeviceFailed:
+		return "failed"
+	default:
+		return ""
+	}
+}
+
+// Device is a connection to a single TCode device. Each session (the listen
+// server, play, tcode) owns its own.
+type Device interface {
+	Connect() error
+	Write(p []byte) (int, error)
+	Read(p []byte) (int, error)
+	Close() error
+	State() DeviceState
+	Info() DeviceInfo
+
+	// Err is the error behind the last failed state, if any.
+	Err() error
+}
+
+// portDevice is a Device backed by a transport opened from a device address,
+// usually a serial port.
+type portDevice struct {
+	addr string
+	baud uint
+
+	mu           sync.Mutex
+	conn         io.ReadWriteCloser
+	state        DeviceState
+	lastErr      error
+	info         DeviceInfo
+	positions    map[string]TCodeMessage // last position sent per axis
+	reconnecting bool
+	closed       bool
+}
+
+// NewDevice returns the device for addr. virtual:///path/trace.csv is a
+// virtual device that writes its trace to the given path, plain "virtual"
+// uses the --trace flag.
+func NewDevice(addr string, baud uint) Device {
+	if addr == deviceVirtual {
+		return newVirtualDevice(config.Trace)
+	}
+
+	if path, ok := strings.CutPrefix(addr, deviceVirtual+"://"); ok {
+		return newVirtualDevice(path)
+	}
+
+	return &portDevice{
+		addr:      addr,
+		baud:      baud,
+		positions: map[string]TCodeMessage{},
+	}
+}
+
+// setState moves the state machine and logs the transition. d.mu must be
+// held.
+func (d *portDevice) setState(state DeviceState, err error) {
+	d.lastErr = err
+
+	if d.state == state {
+		return
+	}
+
+	l := log.Info()
+	if err != nil {
+		l = log.Warn().Err(err)
+	}
+
+	l.Str("device", d.addr).Str("from", d.state.String()).Str("to", state.String()).Msg("device state")
+
+	d.state = state
+}
+
+func (d *portDevice) open() (io.ReadWriteCloser, error) {
+	addr := d.addr
+	if addr == deviceAuto {
+		p, err := discoverDevice(d.baud)
+		if err != nil {
+			return nil, err
+		}
+
+		addr = p
+	}
+
+	conn, err := openTransport(addr, d.baud)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info().Str("device", addr).Uint("baud", d.baud).Msg("opened device")
+
+	return conn, nil
+}
+
+// attach swaps in a freshly opened connection and starts reading its
+// identification reply. d.mu must be held.
+func (d *portDevice) attach(conn io.ReadWriteCloser) {
+	if d.conn != nil {
+		d.conn.Close()
+	}
+
+	d.conn = conn
+	d.info = DeviceInfo{}
+	d.setState(DeviceConnected, nil)
+
+	go d.readLoop(conn)
+	go d.identify(conn)
+}
+
+// identify sends the D0/D1/D2 query, and again once the device has had time
+// to boot if the first one went unanswered.
+func (d *portDevice) identify(conn io.ReadWriteCloser) {
+	for _, delay := range []time.Duration{0, probeSettle} {
+		time.Sleep(delay)
+
+		d.mu.Lock()
+
+		if d.conn != conn || len(d.info.Axes) > 0 {
+			d.mu.Unlock()
+
+			return
+		}
+
+		d.info.queried()
+		_, err := conn.Write([]byte(identifyQuery))
+		d.mu.Unlock()
+
+		if err != nil {
+			log.Debug().Err(err).Msg("failed to query device info")
+
+			return
+		}
+	}
+}
+
+func (d *portDevice) readLoop(conn io.ReadWriteCloser) {
+	scanner := bufio.NewScanner(conn)
+
+	defer func() {
+		err := scanner.Err()
+		if err == nil {
+			err = io.EOF
+		}
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		if d.conn == conn && isDisconnect(err) {
+			d.disconnect(err)
+		}
+	}()
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		d.mu.Lock()
+		if d.conn != conn {
+			d.mu.Unlock()
+
+			return
+		}
+
+		ok := d.info.parse(line)
+		info := d.info
+		d.mu.Unlock()
+
+		if ok {
+			log.Debug().Str("line", line).Any("info", info).Msg("device info")
+		} else {
+			log.Trace().Str("line", line).Msg("device")
+		}
+	}
+}
+
+// Connect opens the device. If that fails the device keeps retrying in the
+// background.
+func (d *portDevice) Connect() error {
+	d.mu.Lock()
+	d.closed = false
+	d.setState(DeviceConnecting, nil)
+	d.mu.Unlock()
+
+	conn, err := d.open()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err != nil {
+		d.setState(DeviceFailed, err)
+		d.startReconnect()
+
+		return err
+	}
+
+	d.attach(conn)
+
+	return nil
+}
+
+func (d *portDevice) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.conn == nil {
+		return 0, errNotConnected
+	}
+
+	n, err := d.conn.Write(p)
+	if err != nil {
+		if isDisconnect(err) {
+			d.disconnect(err)
+
+			return n, errNotConnected
+		}
+
+		return n, err
+	}
+
+	d.remember(p)
+
+	return n, nil
+}
+
+// remember records the last position sent to each axis so it can be resent
+// after a reconnect. d.mu must be held.
+func (d *portDevice) remember(p []byte) {
+	cmds, err := ParseTCode(string(p))
+	if err != nil {
+		return
+	}
+
+	for _, cmd := range cmds {
+		if msg, ok := cmd.(TCodeMessage); ok {
+			d.positions[msg.ID()] = msg
+		}
+	}
+}
+
+// resend moves every axis back to the last position sent before the
+// connection dropped. d.mu must be held.
+func (d *portDevice) resend() {
+	if len(d.positions) == 0 {
+		return
+	}
+
+	cmds := make([]string, 0, len(d.positions))
+	for _, msg := range d.positions {
+		msg.Speed = 0
+		msg.Duration = resendInterval
+		cmds = append(cmds, msg.String())
+	}
+
+	// the device may have moved anywhere while it was gone
+	limiter.Forget(d)
+
+	line := limiter.Apply(d, strings.Join(cmds, " "), true)
+
+	_, err := d.conn.Write([]byte(line + "\n"))
+	if err != nil {
+		log.Warn().Err(err).Str("device", d.addr).Msg("failed to resend position")
+
+		return
+	}
+
+	log.Info().Str("device", d.addr).Str("tcode", line).Msg("resent position")
+}
+
+func (d *portDevice) Read(p []byte) (int, error) {
+	d.mu.Lock()
+	conn := d.conn
+	d.mu.Unlock()
+
+	if conn == nil {
+		return 0, errNotConnected
+	}
+
+	return conn.Read(p)
+}
+
+func (d *portDevice) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.closed = true
+	d.setState(DeviceDisconnected, nil)
+
+	if d.conn == nil {
+		return nil
+	}
+
+	err := d.conn.Close()
+	d.conn = nil
+
+	return err
+}
+
+func (d *portDevice) State() DeviceState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.state
+}
+
+// Err is the error behind the last failed state, if any.
+func (d *portDevice) Err() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.lastErr
+}
+
+func (d *portDevice) Info() DeviceInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	info := d.info
+	info.Axes = append([]DeviceAxis(nil), d.info.Axes...)
+
+	return info
+}
+
+// disconnect drops a connection that went away and starts reconnecting.
+// d.mu must be held.
+func (d *portDevice) disconnect(err error) {
+	if d.conn != nil {
+		d.conn.Close()
+		d.conn = nil
+	}
+
+	d.setState(DeviceFailed, err)
+	d.startReconnect()
+}
+
+// startReconnect starts the reconnect loop unless one is already running or
+// the device was closed. d.mu must be held.
+func (d *portDevice) startReconnect() {
+	if d.reconnecting || d.closed {
+		return
+	}
+
+	d.reconnecting = true
+
+	go d.reconnect(reconnectInterval)
+}
+
+// reconnect retries opening the device every dur, backing off, until it's
+// back or closed. It clears reconnecting in the same critical section it
+// gives up or attaches in, so a connection dropping right after the attach
+// starts a new loop.
+func (d *portDevice) reconnect(dur time.Duration) {
+	ticker := time.NewTicker(dur)
+
+	defer ticker.Stop()
+
+	for range ticker.C {
+		d.mu.Lock()
+
+		if d.closed || d.state == DeviceConnected {
+			d.reconnecting = false
+			d.mu.Unlock()
+
+			return
+		}
+
+		d.setState(DeviceConnecting, nil)
+		d.mu.Unlock()
+
+		conn, err := d.open()
+		if err != nil {
+			d.mu.Lock()
+			d.setState(DeviceFailed, err)
+			d.mu.Unlock()
+
+			dur += time.Duration(float64(dur) * 0.2)
+
+			if dur > reconnectMax {
+				dur = reconnectMax
+			}
+
+			log.Warn().Err(err).Msgf("failed to connect to device, retrying %d seconds", int(dur.Seconds()))
+
+			ticker.Reset(dur)
+
+			continue
+		}
+
+		d.mu.Lock()
+
+		d.reconnecting = false
+
+		if d.closed {
+			d.mu.Unlock()
+			conn.Close()
+
+			return
+		}
+
+		d.attach(conn)
+		d.resend()
+		d.mu.Unlock()
+
+		return
+	}
+}
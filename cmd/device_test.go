@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readUntil reads lines from conn until one contains want.
+func readUntil(t *testing.T, conn net.Conn, want string) {
+	t.Helper()
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	r := bufio.NewReader(conn)
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading until %q: %v", want, err)
+		}
+
+		if strings.Contains(line, want) {
+			return
+		}
+	}
+}
+
+func TestDeviceReconnect(t *testing.T) {
+	interval := reconnectInterval
+	reconnectInterval = time.Millisecond
+
+	t.Cleanup(func() { reconnectInterval = interval })
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 8)
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			accepted <- c
+		}
+	}()
+
+	accept := func() net.Conn {
+		t.Helper()
+
+		select {
+		case c := <-accepted:
+			return c
+		case <-time.After(2 * time.Second):
+			t.Fatal("device didn't connect")
+
+			return nil
+		}
+	}
+
+	d := NewDevice("tcp://"+l.Addr().String(), 0).(*portDevice)
+
+	err = d.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer d.Close()
+
+	conn := accept()
+	readUntil(t, conn, "D0")
+
+	_, err = d.Write([]byte("L05000\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readUntil(t, conn, "L05000")
+
+	// drop the connection as soon as the device is back, many times over,
+	// every drop has to start a new reconnect loop
+	for range 50 {
+		conn.Close()
+		conn = accept()
+	}
+
+	readUntil(t, conn, "L05000I")
+
+	defer conn.Close()
+
+	// a second loop would open another connection
+	select {
+	case c := <-accepted:
+		c.Close()
+		t.Fatal("device connected twice")
+	case <-time.After(100 * reconnectInterval):
+	}
+
+	d.mu.Lock()
+	state, reconnecting := d.state, d.reconnecting
+	d.mu.Unlock()
+
+	if state != DeviceConnected || reconnecting {
+		t.Fatalf("state = %s reconnecting = %v, want connected and not reconnecting", state, reconnecting)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// identifyQuery asks for the device name (D0), tcode version (D1) and the
+// axes it supports (D2).
+const identifyQuery = "D0\nD1\nD2\n"
+
+// identifyTimeout is how long play waits for the device to list its axes.
+const identifyTimeout = probeSettle + time.Second
+
+var deviceAxisLine = regexp.MustCompile(`^([LRVA])(\d)\s+(\d+)\s+(\d+)(?:\s+(.*))?$`)
+
+type DeviceAxis struct {
+	Axis    Axis   `json:"axis"`
+	Channel int    `json:"channel"`
+	Min     int    `json:"min"`
+	Max     int    `json:"max"`
+	Name    string `json:"name,omitempty"`
+}
+
+func (a DeviceAxis) String() string {
+	return fmt.Sprintf("%s%d", a.Axis, a.Channel)
+}
+
+type DeviceInfo struct {
+	Name    string       `json:"name"`
+	Version string       `json:"version"`
+	Axes    []DeviceAxis `json:"axes"`
+
+	// nameQueried is set while a D0 query is waiting for its reply.
+	nameQueried bool
+}
+
+// queried records that a D0 query went out, so the next line that isn't a
+// version or an axis is taken as the device name.
+func (i *DeviceInfo) queried() {
+	i.nameQueried = i.Name == ""
+}
+
+// HasAxis reports whether the device drives axis/channel. A device that
+// hasn't reported its axes is assumed to support all of them.
+func (i DeviceInfo) HasAxis(axis Axis, channel int) bool {
+	if len(i.Axes) == 0 {
+		return true
+	}
+
+	for _, a := range i.Axes {
+		if a.Axis == axis && a.Channel == channel {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parse folds one line of a D0/D1/D2 reply into the info. It returns false
+// for lines that aren't part of an identification reply. A free-form line
+// only becomes the name right after a D0 query, the D0 reply comes before
+// the D1 one.
+func (i *DeviceInfo) parse(line string) bool {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.EqualFold(line, "ok") {
+		return false
+	}
+
+	if strings.HasPrefix(strings.ToLower(line), "tcode") {
+		i.Version = line
+		i.nameQueried = false
+
+		return true
+	}
+
+	if m := deviceAxisLine.FindStringSubmatch(line); m != nil {
+		channel, _ := strconv.Atoi(m[2])
+		lo, _ := strconv.Atoi(m[3])
+		hi, _ := strconv.Atoi(m[4])
+
+		axis := DeviceAxis{
+			Axis:    Axis(m[1]),
+			Channel: channel,
+			Min:     lo,
+			Max:     hi,
+			Name:    m[5],
+		}
+
+		for n, a := range i.Axes {
+			if a.Axis == axis.Axis && a.Channel == axis.Channel {
+				i.Axes[n] = axis
+
+				return true
+			}
+		}
+
+		i.Axes = append(i.Axes, axis)
+
+		return true
+	}
+
+	if i.nameQueried {
+		i.Name = line
+		i.nameQueried = false
+
+		return true
+	}
+
+	return false
+}
+
+// awaitDeviceInfo waits up to timeout for the device to report its axes.
+func awaitDeviceInfo(dev Device, timeout time.Duration) DeviceInfo {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		info := dev.Info()
+		if len(info.Axes) > 0 || dev.State() != DeviceConnected || time.Now().After(deadline) {
+			return info
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
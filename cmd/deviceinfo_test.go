@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestDeviceInfoParse(t *testing.T) {
+	var info DeviceInfo
+
+	// noise before a query isn't a name
+	if info.parse("ets Jun  8 2016 00:22:57") || info.Name != "" {
+		t.Fatalf("name = %q from a line nobody asked for", info.Name)
+	}
+
+	info.queried()
+
+	for _, line := range []string{"OSR2", "TCode v0.3", "L0 0 9999 Up", "R0 0 9999 Twist", "garbage"} {
+		info.parse(line)
+	}
+
+	if info.Name != "OSR2" || info.Version != "TCode v0.3" {
+		t.Fatalf("got name %q version %q, want OSR2 and TCode v0.3", info.Name, info.Version)
+	}
+
+	if len(info.Axes) != 2 || info.Axes[1].Name != "Twist" {
+		t.Fatalf("axes = %v, want L0 and R0", info.Axes)
+	}
+
+	// a device without a name answers D1 straight away
+	info = DeviceInfo{}
+	info.queried()
+
+	for _, line := range []string{"TCode v0.4", "ok", "L0 0 9999"} {
+		info.parse(line)
+	}
+
+	if info.Name != "" {
+		t.Fatalf("name = %q, want none", info.Name)
+	}
+}
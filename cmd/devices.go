@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// DeviceConfig is one entry of the config file's devices list. Axes lists
+// the axes routed to the device, either as tcode ids (L0, V0) or axis names
+// (stroke, vibrate); an empty list routes every axis the device reports.
+type DeviceConfig struct {
+	Device string   `json:"device"`
+	Baud   uint     `json:"baud"`
+	Axes   []string `json:"axes"`
+}
+
+type routedDevice struct {
+	Device
+
+	addr string
+	axes map[string]bool
+}
+
+func (d routedDevice) routes(axis Axis, channel int) bool {
+	if len(d.axes) > 0 && !d.axes[fmt.Sprintf("%s%d", axis, channel)] {
+		return false
+	}
+
+	return d.Info().HasAxis(axis, channel)
+}
+
+// Devices are all the devices of a session. Each axis is routed to the first
+// device that is assigned it.
+type Devices []routedDevice
+
+func NewDevices(cfg Config) Devices {
+	entries := cfg.Devices
+	if len(entries) == 0 {
+		entries = []DeviceConfig{{Device: cfg.Device, Baud: cfg.Baud}}
+	}
+
+	devs := make(Devices, 0, len(entries))
+
+	for _, e := range entries {
+		baud := e.Baud
+		if baud == 0 {
+			baud = cfg.Baud
+		}
+
+		axes := map[string]bool{}
+
+		for _, a := range e.Axes {
+			id, ok := axisID(a)
+			if !ok {
+				log.Warn().Str("device", e.Device).Str("axis", a).Msg("unknown axis")
+
+				continue
+			}
+
+			axes[id] = true
+		}
+
+		devs = append(devs, routedDevice{
+			Device: NewDevice(e.Device, baud),
+			addr:   e.Device,
+			axes:   axes,
+		})
+	}
+
+	return devs
+}
+
+// Connect connects every device, a device that fails to connect doesn't
+// stop the others.
+func (ds Devices) Connect() error {
+	var errs []error
+
+	for _, d := range ds {
+		err := d.Connect()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", d.addr, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (ds Devices) Close() {
+	for _, d := range ds {
+		err := d.Close()
+		if err != nil {
+			log.Warn().Err(err).Str("device", d.addr).Msg("failed to close device")
+		}
+	}
+}
+
+// Route returns the device that drives axis/channel, or nil if none does.
+func (ds Devices) Route(axis Axis, channel int) Device {
+	for _, d := range ds {
+		if d.routes(axis, channel) {
+			return d.Device
+		}
+	}
+
+	return nil
+}
+
+// Send splits a line of tcode between the devices its axes are routed to.
+// Commands that aren't for an axis (D0, DSTOP, ...) go to every device.
+func (ds Devices) Send(cmd string) error {
+	return ds.send(cmd, sendTCode)
+}
+
+// SendRaw is Send past the velocity limiter.
+func (ds Devices) SendRaw(cmd string) error {
+	return ds.send(cmd, sendRawTCode)
+}
+
+func (ds Devices) send(cmd string, send func(Device, string) error) error {
+	cmds, err := ParseTCode(cmd)
+	if err != nil {
+		return err
+	}
+
+	lines := map[Device][]string{}
+
+	for _, c := range cmds {
+		var (
+			axis    Axis
+			channel int
+		)
+
+		switch c := c.(type) {
+		case TCodeMessage:
+			axis, channel = c.Axis, c.Channel
+		case SaveCommand:
+			axis, channel = c.Axis, c.Channel
+		default:
+			for _, d := range ds {
+				lines[d.Device] = append(lines[d.Device], c.String())
+			}
+
+			continue
+		}
+
+		dev := ds.Route(axis, channel)
+		if dev == nil {
+			log.Debug().Str("tcode", c.String()).Msg("no device for axis")
+
+			continue
+		}
+
+		lines[dev] = append(lines[dev], c.String())
+	}
+
+	var errs []error
+
+	for dev, cmds := range lines {
+		err := send(dev, strings.Join(cmds, ", "))
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Park moves every axis the devices report to rest, whether or not anything
+// is playing on it.
+func (ds Devices) Park() {
+	p := params.Load()
+
+	for _, d := range ds {
+		axes := d.Info().Axes
+		if len(axes) == 0 {
+			continue
+		}
+
+		cmds := make([]string, 0, len(axes))
+		for _, a := range axes {
+			cmds = append(cmds, parkMessage(p, a.Axis, a.Channel).String())
+		}
+
+		err := sendTCode(d.Device, strings.Join(cmds, ", "))
+		if err != nil {
+			log.Error().Err(err).Str("device", d.addr).Msg("failed to park device")
+		}
+	}
+}
+
+// awaitInfo waits for every device to report its axes.
+func (ds Devices) awaitInfo() {
+	for _, d := range ds {
+		awaitDeviceInfo(d, identifyTimeout)
+	}
+}
+
+type deviceStatus struct {
+	Device string     `json:"device"`
+	State  string     `json:"state"`
+	Error  string     `json:"error,omitempty"`
+	Axes   []string   `json:"axes,omitempty"`
+	Info   DeviceInfo `json:"info"`
+}
+
+func (ds Devices) Status() []deviceStatus {
+	status := make([]deviceStatus, 0, len(ds))
+
+	for _, d := range ds {
+		s := deviceStatus{
+			Device: d.addr,
+			State:  d.State().String(),
+			Info:   d.Info(),
+		}
+
+		if err := d.Err(); err != nil {
+			s.Error = err.Error()
+		}
+
+		for a := range d.axes {
+			s.Axes = append(s.Axes, a)
+		}
+
+		sort.Strings(s.Axes)
+
+		status = append(status, s)
+	}
+
+	return status
+}
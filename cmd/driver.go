@@ -1,76 +1,200 @@
 package main
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
 	"io"
+	"net"
 	"os"
+	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/jacobsa/go-serial/serial"
 	"github.com/rs/zerolog/log"
 )
 
-var port io.ReadWriteCloser
+// candidate serial ports for auto-discovery, macOS first then linux.
+var devicePatterns = []string{
+	"/dev/cu.usbserial-*",
+	"/dev/cu.usbmodem*",
+	"/dev/cu.SLAB_USBtoUART*",
+	"/dev/cu.wchusbserial*",
+	"/dev/ttyUSB*",
+	"/dev/ttyACM*",
+}
 
-func connectToDevice() error {
-	p, err := serial.Open(serial.OpenOptions{
-		PortName:        "/dev/cu.usbserial-0001",
-		BaudRate:        115200,
+const (
+	probeSettle  = 2 * time.Second // esp32 boards reset when the port is opened
+	probeTimeout = 2 * time.Second
+)
+
+func openSerial(path string, baud uint) (io.ReadWriteCloser, error) {
+	return serial.Open(serial.OpenOptions{
+		PortName:        path,
+		BaudRate:        baud,
 		DataBits:        8,
 		StopBits:        1,
 		MinimumReadSize: 4,
 		ParityMode:      serial.PARITY_NONE,
 	})
-	if err != nil {
-		return err
+}
+
+// discoverDevice returns the first candidate port that answers a D1 query
+// with a tcode version.
+func discoverDevice(baud uint) (string, error) {
+	candidates := []string{}
+
+	for _, pattern := range devicePatterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return "", fmt.Errorf("failed to glob %s: %w", pattern, err)
+		}
+
+		candidates = append(candidates, matches...)
 	}
 
-	port = p
+	if len(candidates) == 0 {
+		return "", errors.New("no serial ports found")
+	}
 
-	return nil
+	for _, path := range candidates {
+		name, err := probeDevice(path, baud)
+		if err != nil {
+			log.Debug().Err(err).Str("device", path).Msg("probe failed")
+
+			continue
+		}
+
+		log.Info().Str("device", path).Str("name", name).Msg("discovered device")
+
+		return path, nil
+	}
+
+	return "", fmt.Errorf("no tcode device found in %v", candidates)
 }
 
-func attemptReconnect() {
-	dur := 1 * time.Second
-	ticker := time.NewTicker(dur)
+func probeDevice(path string, baud uint) (string, error) {
+	p, err := serial.Open(serial.OpenOptions{
+		PortName:              path,
+		BaudRate:              baud,
+		DataBits:              8,
+		StopBits:              1,
+		InterCharacterTimeout: 100,
+		ParityMode:            serial.PARITY_NONE,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to open port: %w", err)
+	}
 
-	for range ticker.C {
-		err := connectToDevice()
-		if err != nil {
-			dur += time.Duration(float64(dur) * 0.2)
+	defer p.Close()
+
+	time.Sleep(probeSettle)
 
-			if dur > 30*time.Second {
-				dur = 30 * time.Second
+	var info DeviceInfo
+
+	info.queried()
+
+	_, err = p.Write([]byte("D0\nD1\n"))
+	if err != nil {
+		return "", fmt.Errorf("failed to write query: %w", err)
+	}
+
+	lines := make(chan string)
+	done := make(chan struct{})
+
+	defer close(done)
+
+	go func() {
+		defer close(lines)
+
+		scanner := bufio.NewScanner(p)
+		for scanner.Scan() {
+			select {
+			case lines <- strings.TrimSpace(scanner.Text()):
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	timeout := time.After(probeTimeout)
+
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				lines = nil
+
+				continue
 			}
 
-			log.Warn().Err(err).Msgf("failed to connect to device, retrying %d seconds", int(dur.Seconds()))
+			info.parse(line)
 
-			ticker.Reset(dur)
-		} else {
-			log.Info().Msg("connected to device")
+			if info.Version != "" {
+				if info.Name == "" {
+					return info.Version, nil
+				}
 
-			return
+				return info.Name, nil
+			}
+		case <-timeout:
+			// a port that answers with anything but a version isn't a
+			// tcode device
+			return "", errors.New("no tcode version in reply to identification query")
+		}
+	}
+}
+
+// isDisconnect reports whether an i/o error means the device went away, as
+// opposed to a one-off failure. ENXIO is macOS's "device not configured",
+// linux reports EIO or ENODEV for an unplugged usb serial adapter.
+func isDisconnect(err error) bool {
+	for _, target := range []error{
+		syscall.ENXIO,
+		syscall.ENODEV,
+		syscall.EIO,
+		syscall.EPIPE,
+		syscall.EBADF,
+		syscall.ECONNRESET,
+		syscall.ECONNREFUSED,
+		syscall.ECONNABORTED,
+		syscall.ENETUNREACH,
+		syscall.EHOSTUNREACH,
+		io.EOF,
+		io.ErrUnexpectedEOF,
+		io.ErrClosedPipe,
+		os.ErrClosed,
+		net.ErrClosed,
+	} {
+		if errors.Is(err, target) {
+			return true
 		}
 	}
+
+	return false
 }
 
-func sendTCode(cmd string) error {
-	cmd = strings.TrimSuffix(cmd, "\n")
+func sendTCode(dev Device, cmd string) error {
+	return writeTCode(dev, limiter.Apply(dev, strings.TrimSuffix(cmd, "\n"), true))
+}
+
+// sendRawTCode sends cmd as is, past the limiter.
+func sendRawTCode(dev Device, cmd string) error {
+	return writeTCode(dev, limiter.Apply(dev, strings.TrimSuffix(cmd, "\n"), false))
+}
 
+func writeTCode(dev Device, cmd string) error {
 	if cmd == "" {
 		return nil
 	}
 
-	if port != nil {
-		_, err := port.Write([]byte(cmd + "\n"))
+	if dev != nil && dev.State() == DeviceConnected {
+		_, err := dev.Write([]byte(cmd + "\n"))
 		if err != nil {
-			if strings.HasSuffix(err.Error(), "device not configured") {
-				log.Warn().Err(err).Msg("device not configured, most likely disconnected")
-
-				port = nil
-
-				go attemptReconnect()
-
+			if errors.Is(err, errNotConnected) {
 				return nil
 			}
 
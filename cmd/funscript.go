@@ -4,9 +4,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/rs/zerolog/log"
@@ -30,15 +32,46 @@ var axisMap = map[string]Script{
 	"valve":   {Axis: AxisVibrate, Channel: 2},
 }
 
+// axisID maps an axis name from axisMap or a raw tcode id (l0, R1) to the
+// tcode id, e.g. twist -> R0.
+func axisID(name string) (string, bool) {
+	if s, ok := axisMap[strings.ToLower(name)]; ok {
+		return fmt.Sprintf("%s%d", s.Axis, s.Channel), true
+	}
+
+	id := strings.ToUpper(name)
+	if len(id) == 2 && isAxis(id[0]) && id[1] >= '0' && id[1] <= '9' {
+		return id, true
+	}
+
+	return "", false
+}
+
+// axisName is the axisMap name of a tcode id, or the id itself if it has
+// none.
+func axisName(id string) string {
+	for name, s := range axisMap {
+		if fmt.Sprintf("%s%d", s.Axis, s.Channel) == id {
+			return name
+		}
+	}
+
+	return id
+}
+
 type FunscriptAction struct {
 	At  int `json:"at"`
 	Pos int `json:"pos"`
 }
 
 type Script struct {
-	path     string // for debugging
-	name     string // for debugging
-	filename string // for debugging
+	path      string // for debugging
+	name      string // for debugging
+	filename  string // for debugging
+	base      string // filename without axis and modifier
+	embedded  bool   // expanded from another script's axes
+	generated bool   // derived from the stroke by a generator
+	loop      bool   // played over and over, for patterns
 
 	Axis     Axis      `json:"-"`
 	Channel  int       `json:"-"`
@@ -50,9 +83,115 @@ type Script struct {
 	Inverted any               `json:"inverted"`
 	Range    int               `json:"range"`
 	Version  string            `json:"version"`
+
+	// Metadata is decoded separately from RawMetadata so a malformed
+	// metadata object doesn't stop the script from playing.
+	Metadata    ScriptMetadata  `json:"-"`
+	RawMetadata json.RawMessage `json:"metadata,omitempty"`
+
+	// Axes holds the other axes of a multi-axis script, the top-level
+	// actions are the stroke.
+	Axes []ScriptAxis `json:"axes,omitempty"`
+}
+
+type ScriptAxis struct {
+	ID       string            `json:"id"`
+	Actions  []FunscriptAction `json:"actions"`
+	Inverted any               `json:"inverted,omitempty"`
+	Range    int               `json:"range,omitempty"`
+}
+
+// Expand splits a multi-axis script into one script per axis. The parent is
+// only kept if it has top-level actions.
+func (s *Script) Expand() []*Script {
+	scripts := []*Script{}
+
+	if len(s.Actions) > 0 || len(s.Axes) == 0 {
+		scripts = append(scripts, s)
+	}
+
+	for _, a := range s.Axes {
+		id, ok := axisID(a.ID)
+		if !ok {
+			log.Warn().Str("id", a.ID).Msgf("unknown axis in %s", s.filename)
+
+			continue
+		}
+
+		axis := &Script{
+			path:     s.path,
+			name:     axisName(id),
+			filename: s.filename,
+			base:     s.base,
+			embedded: true,
+			Axis:     Axis(id[:1]),
+			Channel:  int(id[1] - '0'),
+			Modifier: s.Modifier,
+			Actions:  a.Actions,
+			Inverted: s.Inverted,
+			Range:    s.Range,
+			Version:  s.Version,
+			Metadata: s.Metadata,
+		}
+
+		if a.Inverted != nil {
+			axis.Inverted = a.Inverted
+		}
+
+		if a.Range != 0 {
+			axis.Range = a.Range
+		}
+
+		scripts = append(scripts, axis)
+	}
+
+	return scripts
+}
+
+// IsInverted reports whether the script's inverted field is set. Tools
+// write it as a bool, but strings and numbers show up too.
+func (s Script) IsInverted() bool {
+	switch v := s.Inverted.(type) {
+	case bool:
+		return v
+	case string:
+		b, _ := strconv.ParseBool(v)
+
+		return b
+	case float64:
+		return v != 0
+	default:
+		return false
+	}
+}
+
+// normalize maps a position from the script's range to 0-100, flipping it
+// if invert is set.
+func (s Script) normalize(pos int, invert bool) float64 {
+	p := float64(pos)
+
+	if s.Range > 0 && s.Range != 100 {
+		p = p * 100 / float64(s.Range)
+	}
+
+	p = math.Max(0, math.Min(100, p))
+
+	if invert {
+		p = 100 - p
+	}
+
+	return p
 }
 
 func (s Script) String() string {
+	if s.embedded {
+		return fmt.Sprintf("%s: %s (embedded)", s.name, s.filename)
+	}
+
+	if s.generated {
+		return fmt.Sprintf("%s: %s (generated)", s.name, s.filename)
+	}
+
 	if s.Modifier != ScriptModDefault {
 		return fmt.Sprintf("%s (%s): %s", s.name, s.Modifier, s.filename)
 	}
@@ -61,9 +200,14 @@ func (s Script) String() string {
 }
 
 type Scripts struct {
-	preferedModifier ScriptMod
+	// preferred modifiers, most preferred first
+	preferred []ScriptMod
+	filename  string
+
+	scripts  map[string]*Script   // selected script per axis
+	variants map[string][]*Script // every script found per axis
 
-	scripts map[string]*Script
+	pattern bool // playing a pattern rather than scripts
 }
 
 func NewScript(path string) (*Script, error) {
@@ -71,26 +215,38 @@ func NewScript(path string) (*Script, error) {
 	script := Script{}
 	script.path = path
 
-	switch {
-	case strings.HasSuffix(name, ".soft"):
-		script.Modifier = ScriptModSoft
-	case strings.HasSuffix(name, ".hard"):
-		script.Modifier = ScriptModHard
-	case strings.HasSuffix(name, ".alt"):
-		script.Modifier = ScriptModAlt
-	}
-
 	script.filename = filepath.Base(name)
 
-	ext := filepath.Ext(script.filename)
-	if script.Modifier != ScriptModDefault {
-		ext = strings.TrimSuffix(ext, "."+script.Modifier.String())
+	// the axis and modifier can come in either order, video.soft.twist or
+	// video.twist.soft
+	ext := ""
+	base := script.filename
+
+	for {
+		tok := strings.TrimPrefix(filepath.Ext(base), ".")
+		if tok == "" {
+			break
+		}
+
+		if mod, ok := parseScriptMod(tok); ok && script.Modifier == ScriptModDefault {
+			script.Modifier = mod
+		} else if _, ok := axisMap[tok]; ok && ext == "" {
+			ext = tok
+		} else {
+			break
+		}
+
+		base = strings.TrimSuffix(base, "."+tok)
 	}
 
-	if ext != "" {
-		ext = ext[1:]
-	} else {
+	script.base = base
+
+	if ext == "" {
 		ext = defaultAxis
+
+		if unknown := filepath.Ext(base); unknown != "" {
+			log.Warn().Str("ext", unknown[1:]).Msgf("unknown axis")
+		}
 	}
 
 	if s, ok := axisMap[ext]; ok {
@@ -98,8 +254,6 @@ func NewScript(path string) (*Script, error) {
 		script.Axis = s.Axis
 		script.Channel = s.Channel
 	} else {
-		log.Warn().Str("ext", ext).Msgf("unknown axis")
-
 		s := axisMap[defaultAxis]
 		script.name = defaultAxis
 		script.Axis = s.Axis
@@ -120,9 +274,42 @@ func NewScript(path string) (*Script, error) {
 
 	f.Close()
 
+	if len(script.RawMetadata) > 0 {
+		err = json.Unmarshal(script.RawMetadata, &script.Metadata)
+		if err != nil {
+			log.Warn().Err(err).Msgf("failed to decode metadata of %s", script.filename)
+		}
+	}
+
 	return &script, nil
 }
 
+// writeScript saves a script as a funscript.
+func writeScript(path string, script *Script) error {
+	if script.Inverted == nil {
+		script.Inverted = false
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+
+	err = json.NewEncoder(f).Encode(script)
+	if err != nil {
+		f.Close()
+
+		return fmt.Errorf("failed to encode funscript: %w", err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+
+	return nil
+}
+
 type ScriptMod int
 
 func (s ScriptMod) String() string {
@@ -140,6 +327,19 @@ func (s ScriptMod) String() string {
 	}
 }
 
+func parseScriptMod(s string) (ScriptMod, bool) {
+	switch s {
+	case "alt":
+		return ScriptModAlt, true
+	case "soft":
+		return ScriptModSoft, true
+	case "hard":
+		return ScriptModHard, true
+	default:
+		return ScriptModDefault, false
+	}
+}
+
 const (
 	ScriptModDefault ScriptMod = iota
 	ScriptModAlt
@@ -156,8 +356,105 @@ func (s Scripts) Loaded() []string {
 	return loaded
 }
 
+// Metadata returns the metadata of the stroke script, or of any selected
+// script if the stroke has none.
+func (s Scripts) Metadata() ScriptMetadata {
+	if script, ok := s.scripts[defaultAxis]; ok && !script.Metadata.IsEmpty() {
+		return script.Metadata
+	}
+
+	names := make([]string, 0, len(s.scripts))
+	for name := range s.scripts {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if m := s.scripts[name].Metadata; !m.IsEmpty() {
+			return m
+		}
+	}
+
+	return ScriptMetadata{}
+}
+
 func (s *Scripts) Reset() {
 	s.scripts = map[string]*Script{}
+	s.variants = map[string][]*Script{}
+	s.pattern = false
+}
+
+// forFile reports whether sc belongs to the loaded video, any script does
+// when a whole folder was loaded.
+func (s *Scripts) forFile(sc *Script) bool {
+	return s.filename == "" || strings.HasPrefix(s.filename, sc.base)
+}
+
+// Select picks one variant per axis by preference and reports whether the
+// selection changed. Variants are ranked by the position of their modifier
+// in preferred, then unmodified scripts, then the rest; within a rank a
+// separate per-axis file wins over an axis embedded in a multi-axis script.
+// When a video filename was loaded, only variants named after it are
+// considered, so an axis with none is left out rather than played from
+// another video's script.
+func (s *Scripts) Select(preferred []ScriptMod) bool {
+	s.preferred = preferred
+
+	rank := func(mod ScriptMod) int {
+		for i, m := range preferred {
+			if m == mod {
+				return i
+			}
+		}
+
+		if mod == ScriptModDefault {
+			return len(preferred)
+		}
+
+		return len(preferred) + 1
+	}
+
+	changed := false
+	selected := map[string]*Script{}
+
+	for name, variants := range s.variants {
+		if len(variants) == 0 {
+			continue
+		}
+
+		scripts := make([]*Script, 0, len(variants))
+		for _, sc := range variants {
+			if s.forFile(sc) {
+				scripts = append(scripts, sc)
+			}
+		}
+
+		if len(scripts) == 0 {
+			continue
+		}
+
+		sort.SliceStable(scripts, func(i, j int) bool {
+			ri, rj := rank(scripts[i].Modifier), rank(scripts[j].Modifier)
+			if ri != rj {
+				return ri < rj
+			}
+
+			return !scripts[i].embedded && scripts[j].embedded
+		})
+
+		script := scripts[0]
+
+		if s.scripts[name] != script {
+			changed = true
+		}
+
+		selected[name] = script
+	}
+
+	s.scripts = selected
+
+	return changed
 }
 
 func (s *Scripts) Load(path string) error {
@@ -192,7 +489,8 @@ func (s *Scripts) Load(path string) error {
 		return fmt.Errorf("failed to read dir: %w", err)
 	}
 
-	availableScripts := map[string][]*Script{}
+	s.variants = map[string][]*Script{}
+	s.filename = filename
 
 	// todo: handle script collisions
 	for _, dirent := range dirents {
@@ -211,48 +509,18 @@ func (s *Scripts) Load(path string) error {
 			continue
 		}
 
-		if _, ok := availableScripts[script.name]; !ok {
-			availableScripts[script.name] = []*Script{script}
-		} else {
-			availableScripts[script.name] = append(availableScripts[script.name], script)
-		}
-	}
-
-	for _, axis := range availableScripts {
-		if len(axis) == 0 {
+		// a multi-axis script for another video would bring its axes along
+		if !s.forFile(script) {
 			continue
 		}
 
-		preferedScripts := []*Script{}
-		scripts := []*Script{}
-
-		if len(axis) > 1 {
-			for _, script := range axis {
-				if s.preferedModifier == script.Modifier {
-					preferedScripts = append(preferedScripts, script)
-				} else {
-					scripts = append(scripts, script)
-				}
-			}
-
-			scripts = append(preferedScripts, scripts...)
-
-			if filename != "" {
-				for _, script := range scripts {
-					if strings.HasPrefix(filename, script.filename) {
-						scripts = []*Script{script}
-
-						break
-					}
-				}
-			}
-		} else {
-			scripts = axis
+		for _, sc := range script.Expand() {
+			s.variants[sc.name] = append(s.variants[sc.name], sc)
 		}
-
-		s.scripts[scripts[0].name] = scripts[0]
 	}
 
+	s.Select(s.preferred)
+
 	if len(s.scripts) == 0 {
 		return errors.New("no scripts loaded")
 	}
@@ -267,28 +535,58 @@ func (s *Scripts) Load(path string) error {
 	return nil
 }
 
-func (s *Scripts) TCode() (*TCode, error) {
+func (s *Scripts) TCode(devs Devices) (*TCode, error) {
 	if s == nil {
 		return nil, errors.New("no scripts loaded")
 	}
 
 	tcode := NewTCode()
-	tcode.channels = make([]channel, 0)
+	tcode.channels = s.Channels(devs)
+
+	log.Info().Any("loaded", s.Loaded()).Msgf("loaded %d channels", len(tcode.channels))
+
+	err := devs.Send("L10, L20, L30, A10, R00, R10, R20, V00, V10, A20, V20")
+	if err != nil {
+		return tcode, err
+	}
+
+	return tcode, nil
+}
+
+// Channels fits a channel for each selected or generated script that a
+// device drives.
+func (s *Scripts) Channels(devs Devices) []channel {
+	p := params.Load()
+	channels := make([]channel, 0)
 
+	scripts := make([]*Script, 0, len(s.scripts))
 	for _, script := range s.scripts {
+		scripts = append(scripts, script)
+	}
+
+	for _, script := range append(scripts, s.generated(p.Generators)...) {
+		dev := devs.Route(script.Axis, script.Channel)
+		if dev == nil {
+			log.Info().Msgf("skipping %s: no device drives %s%d", script, script.Axis, script.Channel)
+
+			continue
+		}
+
+		if len(script.Actions) == 0 {
+			log.Warn().Msgf("skipping %s: no actions", script)
+
+			continue
+		}
+
 		ch := channel{}
 
 		ch.axis = script.Axis
 		ch.channel = script.Channel
+		ch.device = dev
 		ch.spline = &interp.FritschButland{}
 		// ch.spline = &interp.AkimaSpline{}
 		// ch.spline = &interp.NaturalCubic{}
 
-		ch.duration = script.Duration
-		if ch.duration == 0 {
-			ch.duration = script.Actions[len(script.Actions)-1].At
-		}
-
 		xs := make([]float64, 0, len(script.Actions))
 		ys := make([]float64, 0, len(script.Actions))
 
@@ -296,9 +594,21 @@ func (s *Scripts) TCode() (*TCode, error) {
 			return script.Actions[i].At < script.Actions[j].At
 		})
 
+		ch.duration = script.Duration
+		if ch.duration == 0 {
+			ch.duration = script.Actions[len(script.Actions)-1].At
+		}
+
+		if script.loop {
+			ch.loop = script.Actions[len(script.Actions)-1].At
+		}
+
+		// the user's per-axis inversion flips whatever the script says
+		invert := script.IsInverted() != p.Invert[fmt.Sprintf("%s%d", script.Axis, script.Channel)]
+
 		for _, action := range script.Actions {
 			xs = append(xs, float64(action.At))
-			ys = append(ys, float64(action.Pos))
+			ys = append(ys, script.normalize(action.Pos, invert))
 		}
 
 		for i := 0; i < len(xs)-1; i++ {
@@ -311,26 +621,25 @@ func (s *Scripts) TCode() (*TCode, error) {
 			}
 		}
 
-		if len(xs) == 0 || len(ys) == 0 {
-			log.Warn().Msgf("skipping %s: no actions", script)
+		// the spline needs at least two points to fit
+		if len(xs) < 2 {
+			log.Warn().Msgf("skipping %s: too few actions", script)
 
 			continue
 		}
 
+		ch.xs = xs
+		ch.ys = ys
+
 		err := ch.spline.Fit(xs, ys)
 		if err != nil {
 			log.Warn().Err(err).Msgf("failed to fit spline for %s", script)
-		}
 
-		tcode.channels = append(tcode.channels, ch)
-	}
-
-	log.Info().Any("loaded", s.Loaded()).Msgf("loaded %d channels", len(tcode.channels))
+			continue
+		}
 
-	err := sendTCode("L10, L20, L30, A10, R00, R10, R20, V00, V10, A20, V20")
-	if err != nil {
-		return tcode, err
+		channels = append(channels, ch)
 	}
 
-	return tcode, nil
+	return channels
 }
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"math"
+	"math/rand/v2"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Generator settings for one derived axis. Amplitude is the share of the
+// axis range used, 0-1, around the center (or from 0 for vibrate).
+type Generator struct {
+	Enabled   bool    `json:"enabled"`
+	Amplitude float64 `json:"amplitude"`
+}
+
+// generateFunc derives an axis from stroke actions with positions in 0-100.
+type generateFunc func(stroke []FunscriptAction, amplitude float64) []FunscriptAction
+
+// generators derive the axes most scripts don't have from the stroke, keyed
+// by tcode id.
+var generators = map[string]generateFunc{
+	"R0": generateTwist,
+	"R1": generateSway(3000, 0),
+	"R2": generateSway(4500, math.Pi/2),
+	"V0": generateVibrate,
+}
+
+var defaultGenerators = map[string]Generator{
+	"R0": {Amplitude: 0.5},
+	"R1": {Amplitude: 0.3},
+	"R2": {Amplitude: 0.3},
+	"V0": {Amplitude: 1},
+}
+
+// applyGeneratorConfig merges the config file's generators, keyed by axis
+// name or tcode id, into p. A missing amplitude keeps the default.
+func applyGeneratorConfig(p *Params, cfg map[string]Generator) {
+	gens := map[string]Generator{}
+	for id, g := range p.Generators {
+		gens[id] = g
+	}
+
+	for name, g := range cfg {
+		id, ok := axisID(name)
+		if _, found := generators[id]; !ok || !found {
+			log.Warn().Str("axis", name).Msg("no generator for axis")
+
+			continue
+		}
+
+		if g.Amplitude == 0 {
+			g.Amplitude = gens[id].Amplitude
+		}
+
+		gens[id] = g
+	}
+
+	p.Generators = gens
+}
+
+// generateTwist turns one way on upstrokes and the other on downstrokes,
+// further the longer the stroke.
+func generateTwist(stroke []FunscriptAction, amplitude float64) []FunscriptAction {
+	actions := make([]FunscriptAction, 0, len(stroke))
+
+	for i, a := range stroke {
+		pos := 50.0
+
+		if i > 0 {
+			pos += float64(a.Pos-stroke[i-1].Pos) / 2 * amplitude
+		}
+
+		actions = append(actions, FunscriptAction{At: a.At, Pos: clampPos(pos)})
+	}
+
+	return actions
+}
+
+// swaySteps is the number of actions per sway cycle.
+const swaySteps = 8
+
+// generateSway rocks back and forth once every period ms over the length of
+// the stroke, independent of how dense its actions are. Each cycle gets a
+// random depth so the motion doesn't repeat; the seed comes from the script
+// so refitting the channels gives the same pattern.
+func generateSway(period float64, phase float64) generateFunc {
+	return func(stroke []FunscriptAction, amplitude float64) []FunscriptAction {
+		if len(stroke) == 0 {
+			return nil
+		}
+
+		first, last := stroke[0].At, stroke[len(stroke)-1].At
+		step := period / swaySteps
+
+		rng := rand.New(rand.NewPCG(uint64(len(stroke)), uint64(last)))
+		actions := make([]FunscriptAction, 0, int(float64(last-first)/step)+2)
+		depth, cycle := 1.0, -1
+
+		for at := float64(first); ; at = math.Min(at+step, float64(last)) {
+			angle := 2*math.Pi*at/period + phase
+
+			if c := int(angle / (2 * math.Pi)); c != cycle {
+				cycle = c
+				depth = 0.5 + rng.Float64()/2
+			}
+
+			pos := 50 + 50*amplitude*depth*math.Sin(angle)
+
+			actions = append(actions, FunscriptAction{At: int(math.Round(at)), Pos: clampPos(pos)})
+
+			if at >= float64(last) {
+				break
+			}
+		}
+
+		return actions
+	}
+}
+
+// vibrateFullSpeed is the stroke speed in units/s that vibrates at full
+// intensity.
+const vibrateFullSpeed = 600
+
+// generateVibrate vibrates with the speed of each stroke, full intensity at
+// vibrateFullSpeed, and stops at the end of the script.
+func generateVibrate(stroke []FunscriptAction, amplitude float64) []FunscriptAction {
+	actions := make([]FunscriptAction, 0, len(stroke))
+
+	for i := 1; i < len(stroke); i++ {
+		intensity := math.Min(1, getSpeed(stroke[i-1], stroke[i])/vibrateFullSpeed)
+
+		actions = append(actions, FunscriptAction{
+			At:  stroke[i-1].At,
+			Pos: clampPos(100 * intensity * amplitude),
+		})
+	}
+
+	if len(stroke) > 0 {
+		actions = append(actions, FunscriptAction{At: stroke[len(stroke)-1].At, Pos: 0})
+	}
+
+	return actions
+}
+
+// generated derives the enabled axes that have no script of their own from
+// the selected stroke script, as configured in gens.
+func (s *Scripts) generated(gens map[string]Generator) []*Script {
+	stroke, ok := s.scripts[defaultAxis]
+	if !ok || len(stroke.Actions) == 0 {
+		return nil
+	}
+
+	actions := make([]FunscriptAction, 0, len(stroke.Actions))
+	for _, a := range sortActions(stroke.Actions) {
+		actions = append(actions, FunscriptAction{At: a.At, Pos: clampPos(stroke.normalize(a.Pos, stroke.IsInverted()))})
+	}
+
+	scripts := []*Script{}
+
+	for id, gen := range generators {
+		g := gens[id]
+		if !g.Enabled {
+			continue
+		}
+
+		name := axisName(id)
+		if _, ok := s.scripts[name]; ok {
+			continue
+		}
+
+		scripts = append(scripts, &Script{
+			path:      stroke.path,
+			name:      name,
+			filename:  stroke.filename,
+			base:      stroke.base,
+			generated: true,
+			loop:      stroke.loop,
+			Axis:      Axis(id[:1]),
+			Channel:   int(id[1] - '0'),
+			Duration:  stroke.Duration,
+			Actions:   gen(actions, g.Amplitude),
+		})
+	}
+
+	return scripts
+}
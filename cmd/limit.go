@@ -0,0 +1,279 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// AxisLimit caps how hard an axis is driven, velocity in funscript units/s
+// and acceleration in units/s², over the full range of the device. 0 turns
+// a limit off.
+type AxisLimit struct {
+	Velocity     float64 `json:"velocity"`
+	Acceleration float64 `json:"acceleration"`
+}
+
+// LimitConfig is the default limit plus overrides per axis, keyed by axis
+// name or tcode id. Unset override fields fall back to the default.
+type LimitConfig struct {
+	AxisLimit
+
+	Axes map[string]AxisLimit `json:"axes"`
+}
+
+// limitWindow is how long after the last command a plain position still
+// counts as part of a stream of ticks. Later ones are turned into I moves,
+// the device would go there at full speed otherwise.
+var limitWindow = 4 * TPS
+
+// limitQuiet is how long an axis has to stay within its limits before
+// limiting it is logged again.
+const limitQuiet = time.Second
+
+var defaultLimitConfig = LimitConfig{
+	AxisLimit: AxisLimit{Velocity: 1000},
+}
+
+// For returns the limit of an axis by tcode id.
+func (c LimitConfig) For(id string) AxisLimit {
+	limit := c.AxisLimit
+
+	for name, l := range c.Axes {
+		if axis, ok := axisID(name); !ok || axis != id {
+			continue
+		}
+
+		if l.Velocity != 0 {
+			limit.Velocity = l.Velocity
+		}
+
+		if l.Acceleration != 0 {
+			limit.Acceleration = l.Acceleration
+		}
+	}
+
+	return limit
+}
+
+// axisMotion is what the limiter knows about an axis: the last move sent
+// to it, from where and until when, and how fast it was moving.
+type axisMotion struct {
+	from, to   float64 // 0-1
+	start, end time.Time
+	velocity   float64 // values/s
+
+	// unknown is set until the first command, the axis could be anywhere
+	unknown bool
+
+	held      bool      // the last command was limited
+	limited   int       // commands limited since limiting kicked in
+	limitedAt time.Time // last command limited
+}
+
+// position is where the axis is at now, part way through its last move.
+func (m *axisMotion) position(now time.Time) float64 {
+	if !now.Before(m.end) {
+		return m.to
+	}
+
+	f := float64(now.Sub(m.start)) / float64(m.end.Sub(m.start))
+
+	return m.from + (m.to-m.from)*f
+}
+
+// Limiter rewrites outgoing linear and rotary axis commands so no axis
+// moves faster than its limits allow. Plain positions, as sent every tick,
+// are moved only as far as velocity and acceleration allow since the last
+// command; I and S moves are slowed down to the velocity limit. An axis
+// that hasn't been sent anything yet is assumed to be a full stroke away.
+type Limiter struct {
+	mu     sync.Mutex
+	motion map[Device]map[string]*axisMotion
+}
+
+var limiter = &Limiter{
+	motion: map[Device]map[string]*axisMotion{},
+}
+
+// Apply limits a line of tcode for dev. With enforce unset the line is
+// passed through as is and only tracked, so later limited commands start
+// from where the axis really is.
+func (l *Limiter) Apply(dev Device, cmd string, enforce bool) string {
+	cmds, err := ParseTCode(cmd)
+	if err != nil {
+		return cmd // sendTCode writes what it's given, let the device reject it
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	axes, ok := l.motion[dev]
+	if !ok {
+		axes = map[string]*axisMotion{}
+		l.motion[dev] = axes
+	}
+
+	now := time.Now()
+	out := make([]string, 0, len(cmds))
+
+	for _, c := range cmds {
+		// vibrate and auxiliary axes are intensities rather than positions
+		msg, ok := c.(TCodeMessage)
+		if !ok || (msg.Axis != AxisLinear && msg.Axis != AxisRotary) {
+			out = append(out, c.String())
+
+			continue
+		}
+
+		m, ok := axes[msg.ID()]
+		if !ok {
+			m = &axisMotion{from: msg.Value, to: msg.Value, unknown: true}
+			axes[msg.ID()] = m
+		}
+
+		if enforce {
+			msg = m.limit(msg, params.Load().Limits.For(msg.ID()), now)
+		} else {
+			m.track(msg, now)
+		}
+
+		out = append(out, msg.String())
+	}
+
+	return strings.Join(out, ", ")
+}
+
+// Forget marks every axis of dev as unknown, for when the device lost
+// track of where it was, so the next move is limited as a full stroke.
+func (l *Limiter) Forget(dev Device) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, m := range l.motion[dev] {
+		m.unknown = true
+	}
+}
+
+// Limiting reports whether any axis of dev is short of where it was last
+// sent, so the same position has to be sent again to get it there.
+func (l *Limiter) Limiting(dev Device) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, m := range l.motion[dev] {
+		if m.held {
+			return true
+		}
+	}
+
+	return false
+}
+
+// track records a command without changing it.
+func (m *axisMotion) track(msg TCodeMessage, now time.Time) {
+	pos := m.position(now)
+	delta := msg.Value - pos
+
+	var d time.Duration
+
+	switch {
+	case msg.Duration > 0:
+		d = msg.Duration
+	case msg.Speed > 0:
+		d = time.Duration(math.Abs(delta) / (float64(msg.Speed) / 1000) * float64(time.Second))
+	}
+
+	switch dt := now.Sub(m.start).Seconds(); {
+	case d > 0:
+		m.velocity = delta / d.Seconds()
+	case dt > 0:
+		m.velocity = delta / dt
+	}
+
+	m.from, m.to = pos, msg.Value
+	m.start, m.end = now, now.Add(d)
+	m.unknown = false
+}
+
+func (m *axisMotion) limit(msg TCodeMessage, limit AxisLimit, now time.Time) TCodeMessage {
+	requested := msg
+	maxVelocity := limit.Velocity / 100 // values/s
+	maxAcceleration := limit.Acceleration / 100
+
+	pos := m.position(now)
+	delta := msg.Value - pos
+
+	if m.unknown {
+		// assume a full stroke in the direction of the move, like a seek ramp
+		delta = math.Copysign(1, delta)
+	}
+
+	switch {
+	case msg.Duration > 0:
+		if maxVelocity > 0 && math.Abs(delta)/msg.Duration.Seconds() > maxVelocity {
+			msg.Duration = time.Duration(math.Abs(delta) / maxVelocity * float64(time.Second))
+		}
+	case msg.Speed > 0:
+		// speed is in units of 1/10000 of the range per 100ms, 1000 per value/s
+		if maxVelocity > 0 && float64(msg.Speed) > maxVelocity*1000 {
+			msg.Speed = max(1, int(maxVelocity*1000))
+		}
+	case now.Sub(m.start) > limitWindow:
+		if maxVelocity > 0 && math.Abs(delta) > maxVelocity*limitWindow.Seconds() {
+			msg.Duration = time.Duration(math.Abs(delta) / maxVelocity * float64(time.Second))
+		}
+	default:
+		dt := now.Sub(m.start).Seconds()
+		if dt <= 0 {
+			break
+		}
+
+		velocity := delta / dt
+
+		if maxAcceleration > 0 {
+			step := maxAcceleration * dt
+			velocity = max(m.velocity-step, min(m.velocity+step, velocity))
+		}
+
+		if maxVelocity > 0 {
+			velocity = max(-maxVelocity, min(maxVelocity, velocity))
+		}
+
+		// never past the target, braking or not knowing where the axis
+		// is can ask for more than it takes to get there
+		next := pos + velocity*dt
+		if (next-requested.Value)*(pos-requested.Value) <= 0 {
+			next = requested.Value
+		}
+
+		msg.Value = max(0, min(1, next))
+	}
+
+	m.track(msg, now)
+
+	m.held = msg != requested
+
+	switch {
+	case m.held:
+		if m.limited == 0 {
+			log.Info().
+				Str("axis", msg.ID()).
+				Str("requested", requested.String()).
+				Str("sent", msg.String()).
+				Msg("limiting axis")
+		}
+
+		m.limited++
+		m.limitedAt = now
+	case m.limited > 0 && now.Sub(m.limitedAt) > limitQuiet:
+		log.Debug().Str("axis", msg.ID()).Int("commands", m.limited).Msg("axis back within limits")
+
+		m.limited = 0
+	}
+
+	return msg
+}
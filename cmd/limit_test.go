@@ -0,0 +1,173 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// testLimit is 1000 units/s, 10 values/s.
+var testLimit = AxisLimit{Velocity: 1000}
+
+// restingAxis is a known axis that arrived at pos at t.
+func restingAxis(pos float64, t time.Time) *axisMotion {
+	return &axisMotion{from: pos, to: pos, start: t, end: t}
+}
+
+func TestLimitTick(t *testing.T) {
+	t0 := time.Now()
+	m := restingAxis(0, t0)
+
+	// one tick later the axis may have moved 10 values/s * 20ms
+	msg := m.limit(TCodeMessage{Axis: AxisLinear, Value: 1}, testLimit, t0.Add(20*time.Millisecond))
+
+	if math.Abs(msg.Value-0.2) > 1e-9 {
+		t.Fatalf("value = %g, want 0.2", msg.Value)
+	}
+
+	if !m.held {
+		t.Fatal("limited move not held")
+	}
+
+	// a slow move goes through as is
+	msg = m.limit(TCodeMessage{Axis: AxisLinear, Value: 0.25}, testLimit, t0.Add(40*time.Millisecond))
+
+	if msg.Value != 0.25 || m.held {
+		t.Fatalf("value = %g held = %v, want 0.25 unheld", msg.Value, m.held)
+	}
+}
+
+func TestLimitAcceleration(t *testing.T) {
+	t0 := time.Now()
+	m := restingAxis(0.5, t0)
+	limit := AxisLimit{Velocity: 1000, Acceleration: 10000} // 100 values/s²
+
+	msg := m.limit(TCodeMessage{Axis: AxisLinear, Value: 1}, limit, t0.Add(20*time.Millisecond))
+
+	// from rest, 2 values/s after 20ms, 0.04 further
+	if math.Abs(msg.Value-0.54) > 1e-9 {
+		t.Fatalf("value = %g, want 0.54", msg.Value)
+	}
+}
+
+func TestLimitNeverPassesTarget(t *testing.T) {
+	t0 := time.Now()
+	m := restingAxis(0, t0)
+	m.velocity = 10 // moving up at full speed
+	limit := AxisLimit{Velocity: 1000, Acceleration: 1000}
+
+	msg := m.limit(TCodeMessage{Axis: AxisLinear, Value: 0.05}, limit, t0.Add(20*time.Millisecond))
+
+	if msg.Value != 0.05 {
+		t.Fatalf("value = %g, want the target 0.05", msg.Value)
+	}
+}
+
+func TestLimitInterval(t *testing.T) {
+	t0 := time.Now()
+	m := restingAxis(0, t0)
+
+	msg := m.limit(TCodeMessage{Axis: AxisLinear, Value: 1, Duration: 50 * time.Millisecond}, testLimit, t0)
+
+	if msg.Duration != 100*time.Millisecond {
+		t.Fatalf("duration = %s, want 100ms", msg.Duration)
+	}
+
+	// halfway through the move the axis is at 0.5
+	if pos := m.position(t0.Add(50 * time.Millisecond)); math.Abs(pos-0.5) > 1e-9 {
+		t.Fatalf("position = %g, want 0.5", pos)
+	}
+}
+
+func TestLimitSpeed(t *testing.T) {
+	t0 := time.Now()
+	m := restingAxis(0, t0)
+
+	msg := m.limit(TCodeMessage{Axis: AxisLinear, Value: 1, Speed: 50000}, testLimit, t0)
+
+	if msg.Speed != 10000 {
+		t.Fatalf("speed = %d, want 10000", msg.Speed)
+	}
+
+	msg = m.limit(TCodeMessage{Axis: AxisLinear, Value: 0, Speed: 500}, testLimit, t0.Add(time.Second))
+
+	if msg.Speed != 500 {
+		t.Fatalf("speed = %d, want 500 left alone", msg.Speed)
+	}
+}
+
+func TestLimitIdlePosition(t *testing.T) {
+	t0 := time.Now()
+	m := restingAxis(0, t0)
+
+	// a lone position after a pause becomes an I move at the limit
+	msg := m.limit(TCodeMessage{Axis: AxisLinear, Value: 0.8}, testLimit, t0.Add(time.Second))
+
+	if msg.Value != 0.8 || msg.Duration != 80*time.Millisecond {
+		t.Fatalf("got %s, want L08000I80", msg)
+	}
+}
+
+func TestLimitUnknown(t *testing.T) {
+	t0 := time.Now()
+
+	// a new axis could be anywhere, the first move takes a full stroke
+	m := &axisMotion{from: 0.9, to: 0.9, unknown: true}
+	msg := m.limit(TCodeMessage{Axis: AxisLinear, Value: 0.9}, testLimit, t0)
+
+	if msg.Duration != 100*time.Millisecond {
+		t.Fatalf("duration = %s, want 100ms", msg.Duration)
+	}
+
+	if m.unknown {
+		t.Fatal("axis still unknown after a move")
+	}
+
+	// a forgotten axis in the middle of ticks moves toward the target
+	for _, target := range []float64{0.1, 0.9} {
+		m := restingAxis(0.5, t0)
+		m.unknown = true
+
+		msg := m.limit(TCodeMessage{Axis: AxisLinear, Value: target}, testLimit, t0.Add(20*time.Millisecond))
+
+		if math.Abs(msg.Value-target) >= math.Abs(0.5-target) {
+			t.Fatalf("target %g: value = %g, moved away from it", target, msg.Value)
+		}
+	}
+
+	// and stays put when it's already there
+	m = restingAxis(0.5, t0)
+	m.unknown = true
+
+	msg = m.limit(TCodeMessage{Axis: AxisLinear, Value: 0.5}, testLimit, t0.Add(20*time.Millisecond))
+
+	if msg.Value != 0.5 {
+		t.Fatalf("value = %g, want 0.5", msg.Value)
+	}
+}
+
+func TestTrack(t *testing.T) {
+	t0 := time.Now()
+	m := restingAxis(0, t0)
+
+	m.track(TCodeMessage{Axis: AxisLinear, Value: 0.5, Duration: 500 * time.Millisecond}, t0)
+
+	if m.velocity != 1 {
+		t.Fatalf("velocity = %g, want 1", m.velocity)
+	}
+
+	if pos := m.position(t0.Add(250 * time.Millisecond)); math.Abs(pos-0.25) > 1e-9 {
+		t.Fatalf("position = %g, want 0.25", pos)
+	}
+
+	// S5000 is 5 values/s, 0.5 takes 100ms
+	m.track(TCodeMessage{Axis: AxisLinear, Value: 0, Speed: 5000}, t0.Add(500*time.Millisecond))
+
+	if !m.end.Equal(t0.Add(600 * time.Millisecond)) {
+		t.Fatalf("move ends at %s, want 600ms", m.end.Sub(t0))
+	}
+
+	if m.velocity != -5 {
+		t.Fatalf("velocity = %g, want -5", m.velocity)
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -42,6 +45,22 @@ func (m MethodCall) GetParam(key string) string {
 	return ""
 }
 
+// ParamsWithPrefix returns every key/value pair whose key starts with
+// prefix, keyed by the rest of the key.
+func (m MethodCall) ParamsWithPrefix(prefix string) map[string]string {
+	p := strings.ToLower(prefix)
+	values := map[string]string{}
+
+	for i := 0; i+1 < len(m.Params.Param); i += 2 {
+		key := m.Params.Param[i].Value.String
+		if strings.HasPrefix(strings.ToLower(key), p) {
+			values[key[len(p):]] = m.Params.Param[i+1].Value.String
+		}
+	}
+
+	return values
+}
+
 func respond(w http.ResponseWriter, status int, msg string) {
 	template := `<?xml version="1.0"?>
 	<methodResponse>
@@ -60,7 +79,7 @@ func respond(w http.ResponseWriter, status int, msg string) {
 	}
 }
 
-func listen(port int) {
+func listen(devs Devices, port int) {
 	var (
 		loadedScripts *Scripts
 		tcode         *TCode
@@ -68,6 +87,67 @@ func listen(port int) {
 
 	closeChan := make(chan bool)
 
+	// halt stops the devices where they are and parks every axis, t may
+	// be nil when nothing is loaded
+	halt := func(t *TCode) {
+		t.Stop()
+
+		err := devs.Send(string(DeviceStop))
+		if err != nil {
+			log.Error().Err(err).Msg("failed to stop device")
+		}
+
+		devs.Park()
+		t.Park()
+	}
+
+	watchdog := NewWatchdog(halt)
+
+	// hosted is set while playback follows a video, which reports in for
+	// the watchdog. Patterns played over rpc have no host.
+	hosted := false
+
+	// start plays loadedScripts from the top, replacing whatever was playing
+	start := func(host bool) {
+		if tcode != nil {
+			tcode.Reset()
+		}
+
+		var err error
+
+		tcode, err = loadedScripts.TCode(devs)
+		if err != nil {
+			panic(err)
+		}
+
+		if os.Getenv("DEBUG") != "" {
+			err = WriteImageFromTcode(tcode, "debug.png")
+			if err != nil {
+				panic(err)
+			}
+		}
+
+		go func() {
+			defer func() {
+				_ = recover() // ignore panic
+			}()
+
+			for frame := range tcode.Tick() {
+				err := frame.Send()
+				if err != nil {
+					panic(err)
+				}
+			}
+		}()
+
+		hosted = host
+		if hosted {
+			watchdog.Arm(tcode)
+		} else {
+			watchdog.Disarm()
+		}
+	}
+
 	// todo: add jsonrpc & grpc (?)
 
 	http.HandleFunc("/xmlrpc", func(w http.ResponseWriter, r *http.Request) {
@@ -88,22 +168,70 @@ func listen(port int) {
 
 		switch call.MethodName {
 		case "close": // no args
+			watchdog.Disarm()
 			tcode.Close()
 			closeChan <- true
 		case "seek": // no args
+			resume := watchdog.Feed()
+
+			// the host reports its position many times a second, so this
+			// corrects the clock rather than jumping to it
 			seek := call.GetParam("seek")
 			if seek != "" {
 				ts, err := time.ParseDuration(seek)
 				if err != nil {
 					log.Error().Err(err).Str("seek", seek).Msg("failed to parse seek")
-
-					return
+				} else {
+					tcode.Sync(ts)
 				}
+			}
 
-				tcode.Seek(ts)
+			if resume {
+				log.Info().Msg("host is back, resuming playback")
+
+				tcode.Play()
+			}
+		case "heartbeat": // no args
+			if watchdog.Feed() {
+				log.Info().Msg("host is back, resuming playback")
+
+				tcode.Play()
+			}
+
+			respond(w, http.StatusOK, "heartbeat")
+		case "stop": // no args
+			watchdog.Disarm()
+			halt(tcode)
+
+			log.Info().Msg("stopped")
+
+			respond(w, http.StatusOK, "stop")
+		case "clock": // no args
+			if tcode == nil {
+				respond(w, http.StatusInternalServerError, "file not loaded")
+
+				return
 			}
+
+			buf, err := json.Marshal(tcode.clock.Stats())
+			if err != nil {
+				respond(w, http.StatusInternalServerError, err.Error())
+
+				return
+			}
+
+			respond(w, http.StatusOK, string(buf))
 		case "version": // no args
 			respond(w, http.StatusOK, "1.0")
+		case "device": // no args
+			buf, err := json.Marshal(devs.Status())
+			if err != nil {
+				respond(w, http.StatusInternalServerError, err.Error())
+
+				return
+			}
+
+			respond(w, http.StatusOK, string(buf))
 		case "load": // L#,R#,V#,script
 			filename := call.GetParam("filename")
 			dir := call.GetParam("folder")
@@ -127,11 +255,19 @@ func listen(port int) {
 
 			log.Debug().Str("filename", filename).Str("dir", dir).Msg("load")
 
+			p := params.Load()
+
 			loadedScripts = &Scripts{
-				preferedModifier: ScriptModSoft,
+				preferred: p.PreferredModifiers(),
 			}
 
 			err := loadedScripts.Load(path)
+			if err != nil && p.Pattern.Fallback {
+				log.Info().Err(err).Str("pattern", p.Pattern.Name).Msg("no scripts, playing pattern")
+
+				err = loadedScripts.LoadPattern(p.Pattern)
+			}
+
 			if err != nil {
 				log.Error().Err(err).Msg("failed to load scripts")
 				respond(w, http.StatusInternalServerError, err.Error())
@@ -143,157 +279,569 @@ func listen(port int) {
 
 			respond(w, http.StatusOK, fmt.Sprintf("loaded %v", loadedScripts.Loaded()))
 
-			if tcode != nil {
-				tcode.Reset()
+			start(true)
+		case "audio": // path, sensitivity
+			opts := defaultAudioOptions
+
+			sensitivity := call.GetParam("sensitivity")
+			if sensitivity != "" {
+				f, err := strconv.ParseFloat(sensitivity, 64)
+				if err != nil {
+					log.Error().Err(err).Str("sensitivity", sensitivity).Msg("failed to parse sensitivity")
+				} else {
+					opts.Sensitivity = f
+				}
+			}
+
+			scripts := &Scripts{
+				preferred: params.Load().PreferredModifiers(),
 			}
 
-			tcode, err = loadedScripts.TCode()
+			err := scripts.LoadAudio(call.GetParam("path"), opts)
 			if err != nil {
-				panic(err)
+				log.Error().Err(err).Msg("failed to load audio")
+				respond(w, http.StatusInternalServerError, err.Error())
+
+				return
+			}
+
+			loadedScripts = scripts
+
+			respond(w, http.StatusOK, fmt.Sprintf("loaded %v", loadedScripts.Loaded()))
+
+			start(true)
+		case "pattern": // name, tempo, min, max, fallback
+			p := params.Load().Pattern
+
+			name := call.GetParam("name")
+			if name != "" && name != "off" {
+				p.Name = name
 			}
 
-			if os.Getenv("DEBUG") != "" {
-				err = WriteImageFromTcode(tcode, "debug.png")
+			tempo := call.GetParam("tempo")
+			if tempo != "" {
+				f, err := strconv.ParseFloat(tempo, 64)
 				if err != nil {
-					panic(err)
+					log.Error().Err(err).Str("tempo", tempo).Msg("failed to parse tempo")
+				} else {
+					p.Tempo = f
 				}
 			}
 
-			go func() {
-				defer func() {
-					_ = recover() // ignore panic
-				}()
+			for key, v := range map[string]*int{"min": &p.Min, "max": &p.Max} {
+				value := call.GetParam(key)
+				if value == "" {
+					continue
+				}
 
-				for msg := range tcode.Tick() {
-					err := sendTCode(msg)
-					if err != nil {
-						panic(err)
-					}
+				n, err := strconv.Atoi(value)
+				if err != nil {
+					log.Error().Err(err).Str(key, value).Msg("failed to parse pattern range")
+
+					continue
 				}
-			}()
+
+				*v = n
+			}
+
+			fallback := call.GetParam("fallback")
+			if fallback != "" {
+				b, err := strconv.ParseBool(fallback)
+				if err != nil {
+					log.Error().Err(err).Str("fallback", fallback).Msg("failed to parse fallback")
+				} else {
+					p.Fallback = b
+				}
+			}
+
+			_, err := p.Script()
+			if err != nil {
+				respond(w, http.StatusInternalServerError, err.Error())
+
+				return
+			}
+
+			params.Update(func(cur *Params) {
+				if p != cur.Pattern {
+					log.Debug().Any("pattern", p).Msg("set pattern")
+				}
+
+				cur.Pattern = p
+			})
+
+			playing := loadedScripts != nil && loadedScripts.pattern && tcode != nil
+
+			switch {
+			case name == "off":
+				if playing {
+					watchdog.Disarm()
+					tcode.Pause()
+					tcode.Reset()
+
+					loadedScripts, tcode = nil, nil
+				}
+			case name != "":
+				loadedScripts = &Scripts{
+					preferred: params.Load().PreferredModifiers(),
+				}
+
+				_ = loadedScripts.LoadPattern(p) // checked above
+
+				start(false)
+			case playing:
+				// refit in place so a tempo or range change doesn't restart it
+				_ = loadedScripts.LoadPattern(p)
+
+				tcode.SetChannels(loadedScripts.Channels(devs))
+			}
+
+			buf, err := json.Marshal(p)
+			if err != nil {
+				respond(w, http.StatusInternalServerError, err.Error())
+
+				return
+			}
+
+			respond(w, http.StatusOK, string(buf))
 		case "set":
 			l := log.Debug()
 			change := false
+			reload := false // channels need refitting
 
-			min := call.GetParam("min")
-			if min != "" {
-				f, err := strconv.ParseFloat(min, 64)
-				if err != nil {
-					log.Error().Err(err).Str("min", min).Msg("failed to parse min")
-				} else {
-					if f != params.Min {
-						l.Float64("min", f)
+			var preferred []ScriptMod
 
-						change = true
+			params.Update(func(p *Params) {
+				min := call.GetParam("min")
+				if min != "" {
+					f, err := strconv.ParseFloat(min, 64)
+					if err != nil {
+						log.Error().Err(err).Str("min", min).Msg("failed to parse min")
+					} else {
+						if f != p.Min {
+							l.Float64("min", f)
+
+							change = true
+						}
+
+						p.Min = f
+					}
+				}
+
+				max := call.GetParam("max")
+				if max != "" {
+					f, err := strconv.ParseFloat(max, 64)
+					if err != nil {
+						log.Error().Err(err).Str("max", max).Msg("failed to parse max")
+					} else {
+						if f != p.Max {
+							l.Float64("max", f)
+
+							change = true
+						}
+
+						p.Max = f
 					}
+				}
 
-					params.Min = f
+				if min > max {
+					p.Max, p.Min = p.Min, p.Max
 				}
-			}
 
-			max := call.GetParam("max")
-			if max != "" {
-				f, err := strconv.ParseFloat(max, 64)
-				if err != nil {
-					log.Error().Err(err).Str("max", max).Msg("failed to parse max")
-				} else {
-					if f != params.Max {
-						l.Float64("max", f)
+				offset := call.GetParam("offset")
+				if offset != "" {
+					d, err := time.ParseDuration(offset)
+					if err != nil {
+						log.Error().Err(err).Str("offset", offset).Msg("failed to parse offset")
+					} else {
+						if d != p.Offset {
+							l.Dur("offset", d)
+
+							change = true
+						}
+
+						p.Offset = d
+					}
+				}
+
+				axisOffsets := call.ParamsWithPrefix("offset.")
+				if len(axisOffsets) > 0 {
+					offsets := map[string]time.Duration{}
+					for id, d := range p.AxisOffsets {
+						offsets[id] = d
+					}
+
+					for axis, value := range axisOffsets {
+						id, ok := axisID(axis)
+						if !ok {
+							log.Error().Str("axis", axis).Msg("unknown axis in offset")
+
+							continue
+						}
+
+						d, err := time.ParseDuration(value)
+						if err != nil {
+							log.Error().Err(err).Str("offset."+axis, value).Msg("failed to parse offset")
+
+							continue
+						}
+
+						if d != offsets[id] {
+							l.Dur("offset."+id, d)
+
+							change = true
+						}
+
+						offsets[id] = d
+					}
+
+					p.AxisOffsets = offsets
+				}
+
+				mode := call.GetParam("mode")
+				if mode != "" {
+					m, err := ParsePlaybackMode(mode)
+					if err != nil {
+						log.Error().Err(err).Str("mode", mode).Msg("failed to parse mode")
+					} else {
+						if m != p.Mode {
+							l.Str("mode", string(m))
+
+							change = true
+						}
+
+						p.Mode = m
+					}
+				}
+
+				rate := call.GetParam("rate")
+				if rate != "" {
+					f, err := strconv.ParseFloat(rate, 64)
+					if err != nil || f <= 0 {
+						log.Error().Err(err).Str("rate", rate).Msg("failed to parse rate")
+					} else {
+						if f != p.Rate {
+							l.Float64("rate", f)
+
+							change = true
+						}
+
+						p.Rate = f
+
+						if tcode != nil {
+							tcode.clock.SetRate(f)
+						}
+					}
+				}
+
+				timeout := call.GetParam("watchdog")
+				if timeout != "" {
+					n, err := strconv.Atoi(timeout)
+					if err != nil || n < 0 {
+						log.Error().Err(err).Str("watchdog", timeout).Msg("failed to parse watchdog")
+					} else {
+						if n != p.Watchdog {
+							l.Int("watchdog", n)
+
+							change = true
+						}
+
+						p.Watchdog = n
+					}
+				}
+
+				// clock.deadband=<ms>, clock.snap=<ms>, clock.slew=<s/s>,
+				// clock.ramp=<ms>, clock.rampSpeed=<units/s>
+				clock := call.ParamsWithPrefix("clock.")
+				if len(clock) > 0 {
+					cfg := p.Clock
+
+					for key, value := range clock {
+						f, err := strconv.ParseFloat(value, 64)
+						if err != nil || f < 0 {
+							log.Error().Err(err).Str("clock."+key, value).Msg("failed to parse clock setting")
+
+							continue
+						}
+
+						switch strings.ToLower(key) {
+						case "deadband":
+							cfg.Deadband = int(f)
+						case "snap":
+							cfg.Snap = int(f)
+						case "slew":
+							cfg.Slew = f
+						case "ramp":
+							cfg.Ramp = int(f)
+						case "rampspeed":
+							cfg.RampSpeed = f
+						default:
+							log.Error().Str("clock."+key, value).Msg("unknown clock setting")
+						}
+					}
+
+					if cfg != p.Clock {
+						l.Any("clock", cfg)
 
 						change = true
 					}
 
-					params.Max = f
+					p.Clock = cfg
 				}
-			}
 
-			if min > max {
-				params.Max, params.Min = params.Min, params.Max
-			}
+				// limit.velocity=<units/s>, limit.acceleration=<units/s²>, and the
+				// same per axis as limit.<axis>.velocity. 0 turns the default limit off,
+				// an axis set to 0 falls back to the default
+				limit := call.ParamsWithPrefix("limit.")
+				if len(limit) > 0 {
+					limits := p.Limits
+					limits.Axes = map[string]AxisLimit{}
 
-			offset := call.GetParam("offset")
-			if offset != "" {
-				d, err := time.ParseDuration(offset)
-				if err != nil {
-					log.Error().Err(err).Str("offset", offset).Msg("failed to parse offset")
-				} else {
-					if d != params.Offset {
-						l.Dur("offset", d)
+					for id, a := range p.Limits.Axes {
+						limits.Axes[id] = a
+					}
+
+					for key, value := range limit {
+						f, err := strconv.ParseFloat(value, 64)
+						if err != nil || f < 0 {
+							log.Error().Err(err).Str("limit."+key, value).Msg("failed to parse limit")
+
+							continue
+						}
+
+						axis, setting, found := strings.Cut(key, ".")
+						if !found {
+							axis, setting = "", key
+						}
+
+						a := limits.AxisLimit
+						if axis != "" {
+							id, ok := axisID(axis)
+							if !ok {
+								log.Error().Str("axis", axis).Msg("unknown axis in limit")
+
+								continue
+							}
+
+							axis = id
+							a = limits.Axes[id]
+						}
+
+						switch strings.ToLower(setting) {
+						case "velocity":
+							a.Velocity = f
+						case "acceleration":
+							a.Acceleration = f
+						default:
+							log.Error().Str("limit."+key, value).Msg("unknown limit setting")
+
+							continue
+						}
+
+						if axis == "" {
+							limits.AxisLimit = a
+						} else {
+							limits.Axes[axis] = a
+						}
+
+						l.Float64("limit."+key, f)
 
 						change = true
 					}
 
-					params.Offset = d
+					p.Limits = limits
 				}
-			}
 
-			const (
-				trueString  = "true"
-				falseString = "false"
-			)
+				const (
+					trueString  = "true"
+					falseString = "false"
+				)
+
+				invert := call.ParamsWithPrefix("invert.")
+				if len(invert) > 0 {
+					inverted := map[string]bool{}
+					for id, b := range p.Invert {
+						inverted[id] = b
+					}
+
+					for axis, value := range invert {
+						id, ok := axisID(axis)
+						if !ok {
+							log.Error().Str("axis", axis).Msg("unknown axis in invert")
+
+							continue
+						}
+
+						b, err := strconv.ParseBool(value)
+						if err != nil {
+							log.Error().Err(err).Str("invert."+axis, value).Msg("failed to parse invert")
+
+							continue
+						}
 
-			alt := call.GetParam("preferAlt")
-			if alt == trueString {
-				if !params.PreferAlt {
-					l.Bool("preferAlt", true)
+						if b != inverted[id] {
+							l.Bool("invert."+id, b)
 
-					change = true
+							reload = true
+							change = true
+						}
+
+						inverted[id] = b
+					}
+
+					p.Invert = inverted
 				}
 
-				params.PreferAlt = true
-			} else if alt == falseString {
-				if params.PreferAlt {
-					l.Bool("preferAlt", false)
+				// generate.<axis>=true|false, generate.<axis>.amplitude=0-1
+				generate := call.ParamsWithPrefix("generate.")
+				if len(generate) > 0 {
+					gens := map[string]Generator{}
+					for id, g := range p.Generators {
+						gens[id] = g
+					}
+
+					for key, value := range generate {
+						axis, setting, _ := strings.Cut(key, ".")
+
+						id, ok := axisID(axis)
+						if _, found := generators[id]; !ok || !found {
+							log.Error().Str("axis", axis).Msg("no generator for axis")
+
+							continue
+						}
+
+						g := gens[id]
+
+						switch setting {
+						case "":
+							b, err := strconv.ParseBool(value)
+							if err != nil {
+								log.Error().Err(err).Str("generate."+key, value).Msg("failed to parse generate")
+
+								continue
+							}
+
+							g.Enabled = b
+						case "amplitude":
+							f, err := strconv.ParseFloat(value, 64)
+							if err != nil || f < 0 || f > 1 {
+								log.Error().Err(err).Str("generate."+key, value).Msg("failed to parse amplitude, expected 0-1")
+
+								continue
+							}
+
+							g.Amplitude = f
+						default:
+							log.Error().Str("generate."+key, value).Msg("unknown generator setting")
+
+							continue
+						}
+
+						if g != gens[id] {
+							l.Any("generate."+id, g)
+
+							reload = true
+							change = true
+						}
+
+						gens[id] = g
+					}
 
-					change = true
+					p.Generators = gens
 				}
 
-				params.PreferAlt = false
-			}
+				preferred = p.PreferredModifiers()
+
+				alt := call.GetParam("preferAlt")
+				if alt == trueString {
+					if !p.PreferAlt {
+						l.Bool("preferAlt", true)
 
-			soft := call.GetParam("preferSoft")
-			if soft == trueString {
-				if !params.PreferSoft {
-					l.Bool("preferSoft", true)
+						change = true
+					}
+
+					p.PreferAlt = true
+				} else if alt == falseString {
+					if p.PreferAlt {
+						l.Bool("preferAlt", false)
+
+						change = true
+					}
 
-					change = true
+					p.PreferAlt = false
 				}
 
-				params.PreferSoft = true
-			} else if soft == falseString {
-				if params.PreferSoft {
-					l.Bool("preferSoft", false)
+				soft := call.GetParam("preferSoft")
+				if soft == trueString {
+					if !p.PreferSoft {
+						l.Bool("preferSoft", true)
 
-					change = true
+						change = true
+					}
+
+					p.PreferSoft = true
+				} else if soft == falseString {
+					if p.PreferSoft {
+						l.Bool("preferSoft", false)
+
+						change = true
+					}
+
+					p.PreferSoft = false
 				}
 
-				params.PreferSoft = false
-			}
+				hard := call.GetParam("preferHard")
+				if hard == trueString {
+					if !p.PreferHard {
+						l.Bool("preferHard", true)
 
-			hard := call.GetParam("preferHard")
-			if hard == trueString {
-				if !params.PreferHard {
-					l.Bool("preferHard", true)
+						change = true
+					}
+
+					p.PreferHard = true
+				} else if hard == falseString {
+					if p.PreferHard {
+						l.Bool("preferHard", false)
 
-					change = true
+						change = true
+					}
+
+					p.PreferHard = false
 				}
+			})
 
-				params.PreferHard = true
-			} else if hard == falseString {
-				if params.PreferHard {
-					l.Bool("preferHard", false)
+			if change {
+				l.Msg("set params")
+			}
 
-					change = true
+			// hot-swap the loaded variants without reloading or losing our place
+			if current := params.Load().PreferredModifiers(); !slices.Equal(preferred, current) && loadedScripts != nil {
+				if loadedScripts.Select(current) {
+					reload = true
+
+					log.Info().Strs("scripts", loadedScripts.Loaded()).Msg("switched script variants")
 				}
+			}
 
-				params.PreferHard = false
+			if reload && loadedScripts != nil && tcode != nil {
+				tcode.SetChannels(loadedScripts.Channels(devs))
 			}
 
-			if change {
-				l.Msg("set params")
+			respond(w, http.StatusOK, effectiveOffsets())
+		case "metadata": // no args
+			if loadedScripts == nil {
+				respond(w, http.StatusInternalServerError, "file not loaded")
+
+				return
 			}
 
-			respond(w, http.StatusOK, "")
+			buf, err := json.Marshal(loadedScripts.Metadata())
+			if err != nil {
+				respond(w, http.StatusInternalServerError, err.Error())
+
+				return
+			}
+
+			respond(w, http.StatusOK, string(buf))
 		case "render": // output
 			if loadedScripts == nil {
 				_, err = w.Write([]byte("no loaded script"))
@@ -325,6 +873,7 @@ func listen(port int) {
 
 			respond(w, http.StatusOK, "pause")
 
+			watchdog.Disarm()
 			tcode.Pause()
 
 			seek := call.GetParam("seek")
@@ -360,6 +909,10 @@ func listen(port int) {
 			}
 
 			tcode.Play()
+
+			if hosted {
+				watchdog.Arm(tcode)
+			}
 		default:
 			log.Debug().Msgf("%s %s %s", r.RemoteAddr, call.MethodName, call.Params)
 		}
@@ -376,3 +929,23 @@ func listen(port int) {
 
 	<-closeChan
 }
+
+// effectiveOffsets describes the offset applied to each axis, e.g.
+// "offset=-80ms R0=-120ms".
+func effectiveOffsets() string {
+	p := params.Load()
+
+	ids := make([]string, 0, len(p.AxisOffsets))
+	for id := range p.AxisOffsets {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	s := fmt.Sprintf("offset=%s", p.Offset)
+	for _, id := range ids {
+		s += fmt.Sprintf(" %s=%s", id, p.OffsetFor(id))
+	}
+
+	return s
+}
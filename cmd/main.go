@@ -23,6 +23,11 @@ func main() {
 	logfile := flag.String("logfile", "", "log file")
 	loglevel := flag.String("loglevel", "info", "log level")
 	logformat := flag.String("logformat", "text", "log format")
+	configfile := flag.String("config", "", "config file (default $XDG_CONFIG_HOME/tcode-player/config.json)")
+	device := flag.String("device", defaultDevicePath, `device address (serial path, udp://host:port, tcp://host:port, virtual), or "auto" to probe serial ports`)
+	baud := flag.Uint("baud", defaultBaudRate, "serial baud rate")
+	mode := flag.String("mode", string(ModeTick), "playback mode: tick (sample every tick), interval or speed (one command per action)")
+	trace := flag.String("trace", "", "write the virtual device's position trace to this .csv or .json file")
 	flag.Parse()
 
 	if os.Getenv("DEBUG") != "" {
@@ -58,10 +63,48 @@ func main() {
 		log.Logger = log.Logger.With().Caller().Logger().Output(zerolog.ConsoleWriter{Out: logWriter})
 	}
 
+	path, explicit := *configfile, *configfile != ""
+	if !explicit {
+		path = defaultConfigPath()
+	}
+
+	err := loadConfig(path, explicit)
+	if err != nil {
+		log.Fatal().Err(err).Str("config", path).Msg("failed to load config")
+	}
+
+	// flags given on the command line win over the config file
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "device":
+			config.Device = *device
+		case "baud":
+			config.Baud = *baud
+		case "trace":
+			config.Trace = *trace
+		}
+	})
+
+	playbackMode, err := ParsePlaybackMode(*mode)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid --mode")
+	}
+
+	params.Update(func(p *Params) {
+		applyGeneratorConfig(p, config.Generators)
+
+		p.Pattern = config.Pattern
+		p.Clock = config.Clock
+		p.Limits = config.Limits
+		p.Watchdog = config.Watchdog
+		p.Mode = playbackMode
+	})
+
 	log.Info().
 		Str("arg0", os.Args[0]).
 		Any("args", os.Args).
 		Str("loglevel", zerolog.GlobalLevel().String()).
+		Str("device", config.Device).
 		Msg("starting tcode-player")
 
 	if len(flag.Args()) == 0 {
@@ -72,6 +115,7 @@ func main() {
 	command := flag.Args()[0]
 	args := flag.Args()[1:]
 	done := make(chan struct{})
+	devs := NewDevices(config)
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
@@ -86,13 +130,15 @@ func main() {
 			fmt.Println("tcode is nil")
 		}
 
+		devs.Close()
+
 		done <- struct{}{}
 	}()
 
 	go func() {
 		switch command {
 		case "listen":
-			err := connectToDevice()
+			err := devs.Connect()
 			if err != nil {
 				log.Warn().Err(err).Msg("failed to connect to device")
 			}
@@ -113,7 +159,7 @@ func main() {
 
 			time.Sleep(time.Millisecond)
 
-			listen(*port)
+			listen(devs, *port)
 		case "render":
 			if len(args) < 2 {
 				fmt.Println("usage: tcode-player render <script> <output>")
@@ -135,28 +181,155 @@ func main() {
 				os.Exit(1)
 			}
 
-			err := connectToDevice()
+			err := devs.Connect()
+			if err != nil {
+				log.Warn().Err(err).Msg("failed to connect to device")
+			}
+
+			err = play(devs, args[0])
+			if err != nil {
+				panic(err)
+			}
+		case "audio":
+			fs := flag.NewFlagSet("audio", flag.ExitOnError)
+			out := fs.String("out", "", "save the generated stroke to this .funscript (and the vibrate next to it) instead of playing it")
+			rate := fs.Int("rate", defaultAudioOptions.Rate, "sample rate of raw pcm input")
+			channels := fs.Int("channels", defaultAudioOptions.Channels, "channels of raw pcm input")
+			sensitivity := fs.Float64("sensitivity", defaultAudioOptions.Sensitivity, "energy over the recent average that counts as a beat")
+			_ = fs.Parse(args)
+
+			if fs.NArg() == 0 {
+				fmt.Println("usage: tcode-player audio [--out <output>] [--rate n] [--channels n] [--sensitivity n] <wav, s16le pcm or ->")
+				os.Exit(1)
+			}
+
+			opts := AudioOptions{Rate: *rate, Channels: *channels, Sensitivity: *sensitivity}
+
+			if *out != "" {
+				err := saveAudioScripts(os.Stdout, fs.Arg(0), *out, opts)
+				if err != nil {
+					fmt.Printf("error: %s\n", err)
+					os.Exit(1)
+				}
+
+				break
+			}
+
+			err := devs.Connect()
 			if err != nil {
 				log.Warn().Err(err).Msg("failed to connect to device")
 			}
 
-			err = play(args[0])
+			scripts := Scripts{}
+
+			err = scripts.LoadAudio(fs.Arg(0), opts)
+			if err != nil {
+				fmt.Printf("error: %s\n", err)
+				os.Exit(1)
+			}
+
+			err = playScripts(devs, &scripts)
 			if err != nil {
 				panic(err)
 			}
+		case "info":
+			fs := flag.NewFlagSet("info", flag.ExitOnError)
+			format := fs.String("format", "text", "output format: text or json")
+			_ = fs.Parse(args)
+
+			if fs.NArg() == 0 {
+				fmt.Println("usage: tcode-player info [--format text|json] <script>")
+				os.Exit(1)
+			}
+
+			err := info(os.Stdout, fs.Arg(0), *format)
+			if err != nil {
+				fmt.Printf("error: %s\n", err)
+				os.Exit(1)
+			}
+		case "stats":
+			fs := flag.NewFlagSet("stats", flag.ExitOnError)
+			format := fs.String("format", "text", "output format: text or json")
+			_ = fs.Parse(args)
+
+			if fs.NArg() == 0 {
+				fmt.Println("usage: tcode-player stats [--format text|json] <script>")
+				os.Exit(1)
+			}
+
+			err := stats(os.Stdout, fs.Arg(0), *format)
+			if err != nil {
+				fmt.Printf("error: %s\n", err)
+				os.Exit(1)
+			}
+		case "transform":
+			fs := flag.NewFlagSet("transform", flag.ExitOnError)
+			out := fs.String("out", "", "write the transformed script to this file")
+			_ = fs.Parse(args)
+
+			if fs.NArg() < 2 || *out == "" {
+				fmt.Println("usage: tcode-player transform --out <output> <script> <step>...")
+				fmt.Println("steps: shift=<ms> remap=<lo>:<hi>[:<curve>] invert limit=<units/s> simplify=<epsilon> min-interval=<ms>")
+				os.Exit(1)
+			}
+
+			err := transform(os.Stdout, fs.Arg(0), *out, fs.Args()[1:])
+			if err != nil {
+				fmt.Printf("error: %s\n", err)
+				os.Exit(1)
+			}
+		case "validate":
+			fs := flag.NewFlagSet("validate", flag.ExitOnError)
+			format := fs.String("format", "text", "output format: text or json")
+			maxSpeed := fs.Float64("max-speed", maxLintSpeed, "flag strokes faster than this many position units per second")
+			_ = fs.Parse(args)
+
+			if fs.NArg() == 0 {
+				fmt.Println("usage: tcode-player validate [--format text|json] [--max-speed n] <script or dir>")
+				os.Exit(1)
+			}
+
+			failed, err := validate(os.Stdout, fs.Arg(0), *format, *maxSpeed)
+			if err != nil {
+				fmt.Printf("error: %s\n", err)
+				os.Exit(1)
+			}
+
+			if failed {
+				os.Exit(1)
+			}
 		case "tcode":
-			if len(args) == 0 {
-				fmt.Println("usage: tcode-player tcode <commands>")
+			fs := flag.NewFlagSet("tcode", flag.ExitOnError)
+			limit := fs.Bool("limit", false, "apply the velocity and acceleration limits to the commands")
+			_ = fs.Parse(args)
+
+			if fs.NArg() == 0 {
+				fmt.Println("usage: tcode-player tcode [--limit] <commands>")
 				os.Exit(1)
 			}
 
-			err := connectToDevice()
+			args = fs.Args()
+
+			send := devs.SendRaw
+			if *limit {
+				send = devs.Send
+			}
+
+			err := devs.Connect()
 			if err != nil {
 				log.Warn().Err(err).Msg("failed to connect to device")
 			}
 
 			for _, cmd := range args {
-				err := sendTCode(cmd)
+				_, err := ParseTCode(cmd)
+				if err != nil {
+					fmt.Printf("error: %s\n", err)
+					os.Exit(1)
+				}
+			}
+
+			for _, cmd := range args {
+				err := send(cmd)
 				if err != nil {
 					panic(err)
 				}
@@ -170,4 +343,6 @@ func main() {
 	}()
 
 	<-done
+
+	devs.Close()
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// ScriptMetadata is the metadata object written by OpenFunscripter and most
+// other script tools. Duration is in seconds.
+type ScriptMetadata struct {
+	Title       string          `json:"title,omitempty"`
+	Creator     string          `json:"creator,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Duration    float64         `json:"duration,omitempty"`
+	License     string          `json:"license,omitempty"`
+	Notes       string          `json:"notes,omitempty"`
+	Performers  []string        `json:"performers,omitempty"`
+	Tags        []string        `json:"tags,omitempty"`
+	Type        string          `json:"type,omitempty"`
+	ScriptURL   string          `json:"script_url,omitempty"`
+	VideoURL    string          `json:"video_url,omitempty"`
+	Chapters    []ScriptChapter `json:"chapters,omitempty"`
+}
+
+// ScriptChapter times are "hh:mm:ss.mmm" strings.
+type ScriptChapter struct {
+	Name      string `json:"name"`
+	StartTime string `json:"startTime"`
+	EndTime   string `json:"endTime"`
+}
+
+func (m ScriptMetadata) IsEmpty() bool {
+	return m.Title == "" && m.Creator == "" && m.Description == "" && m.Duration == 0 &&
+		m.License == "" && m.Notes == "" && len(m.Performers) == 0 && len(m.Tags) == 0 &&
+		m.Type == "" && m.ScriptURL == "" && m.VideoURL == "" && len(m.Chapters) == 0
+}
+
+func writeMetadataText(w io.Writer, script Script) error {
+	m := script.Metadata
+
+	lines := []string{fmt.Sprintf("script:      %s", script.path)}
+
+	add := func(label, value string) {
+		if value != "" {
+			lines = append(lines, fmt.Sprintf("%-12s %s", label+":", value))
+		}
+	}
+
+	add("title", m.Title)
+	add("creator", m.Creator)
+	add("description", m.Description)
+	add("performers", strings.Join(m.Performers, ", "))
+	add("tags", strings.Join(m.Tags, ", "))
+	add("type", m.Type)
+	add("license", m.License)
+	add("script url", m.ScriptURL)
+	add("video url", m.VideoURL)
+	add("notes", m.Notes)
+
+	if m.Duration > 0 {
+		add("duration", (time.Duration(m.Duration * float64(time.Second))).String())
+	}
+
+	add("actions", fmt.Sprintf("%d", len(script.Actions)))
+
+	if len(script.Axes) > 0 {
+		ids := make([]string, 0, len(script.Axes))
+		for _, a := range script.Axes {
+			ids = append(ids, a.ID)
+		}
+
+		add("axes", strings.Join(ids, ", "))
+	}
+
+	if len(m.Chapters) > 0 {
+		lines = append(lines, "chapters:")
+
+		for _, c := range m.Chapters {
+			lines = append(lines, fmt.Sprintf("  %s - %s  %s", c.StartTime, c.EndTime, c.Name))
+		}
+	}
+
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+
+	return err
+}
+
+// info prints a script's metadata as text or json.
+func info(w io.Writer, path string, format string) error {
+	script, err := NewScript(path)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		return enc.Encode(script.Metadata)
+	case "text":
+		return writeMetadataText(w, *script)
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
@@ -1,24 +1,157 @@
 package main
 
-import "time"
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PlaybackMode decides how a script is turned into tcode. ModeTick samples
+// the spline every tick, the others send one command per funscript action
+// and let the firmware interpolate with an I (interval) or S (speed)
+// modifier.
+type PlaybackMode string
+
+const (
+	ModeTick     PlaybackMode = "tick"
+	ModeInterval PlaybackMode = "interval"
+	ModeSpeed    PlaybackMode = "speed"
+)
+
+// PreferredModifiers lists the preferred script variants, most preferred
+// first: hard, then soft, then alt.
+func (p Params) PreferredModifiers() []ScriptMod {
+	mods := []ScriptMod{}
+
+	if p.PreferHard {
+		mods = append(mods, ScriptModHard)
+	}
+
+	if p.PreferSoft {
+		mods = append(mods, ScriptModSoft)
+	}
+
+	if p.PreferAlt {
+		mods = append(mods, ScriptModAlt)
+	}
+
+	return mods
+}
+
+// OffsetFor is the effective offset of an axis.
+func (p Params) OffsetFor(id string) time.Duration {
+	return p.Offset + p.AxisOffsets[id]
+}
+
+func ParsePlaybackMode(s string) (PlaybackMode, error) {
+	switch m := PlaybackMode(s); m {
+	case ModeTick, ModeInterval, ModeSpeed:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown playback mode %q", s)
+	}
+}
 
 type Params struct {
 	Min, Max float64
 
-	Offset time.Duration
+	// Offset shifts the script against the video. A negative offset samples
+	// the script early to make up for device latency, a positive one samples
+	// it late to make up for video/audio pipeline delay. AxisOffsets are
+	// added on top of it for single axes, keyed by tcode id (R0).
+	Offset      time.Duration
+	AxisOffsets map[string]time.Duration
+
+	Mode PlaybackMode
+
+	// Invert flips an axis, keyed by tcode id (R0), on top of the script's
+	// own inverted field.
+	Invert map[string]bool
 
 	PreferSoft bool
 	PreferHard bool
 	PreferAlt  bool
+
+	// Generators derive axes without a script from the stroke, keyed by
+	// tcode id (R0).
+	Generators map[string]Generator
+
+	// Pattern is played by the pattern rpc, and when a video has no script
+	// if its Fallback is set.
+	Pattern Pattern
+
+	Clock ClockConfig
+
+	// Limits cap how fast the axes are driven, see Limiter.
+	Limits LimitConfig
+
+	// Watchdog halts playback after this many ms without a seek or
+	// heartbeat, 0 turns it off.
+	Watchdog int
+
+	// Rate is the playback rate reported by the host, 2 for fast forward.
+	Rate float64
 }
 
-var params = Params{
+var defaultParams = Params{
 	Min: 0.15,
 	Max: 0.75,
 
-	Offset: time.Duration(0),
+	Offset:      time.Duration(0),
+	AxisOffsets: map[string]time.Duration{},
+
+	Mode: ModeTick,
+
+	Invert: map[string]bool{},
 
 	PreferSoft: false,
 	PreferHard: false,
 	PreferAlt:  false,
+
+	Generators: defaultGenerators,
+
+	Pattern: defaultPattern,
+
+	Clock: defaultClockConfig,
+
+	Limits: defaultLimitConfig,
+
+	Watchdog: defaultWatchdog,
+
+	Rate: 1,
+}
+
+// paramStore holds the current Params. Playback reads them while the rpc
+// handlers change them, so they are only ever replaced whole: Load once for
+// a consistent snapshot and never write to it.
+type paramStore struct {
+	mu      sync.Mutex // serializes Update
+	current atomic.Pointer[Params]
+}
+
+func newParamStore(p Params) *paramStore {
+	s := &paramStore{}
+	s.current.Store(&p)
+
+	return s
+}
+
+var params = newParamStore(defaultParams)
+
+// Load returns the current params.
+func (s *paramStore) Load() *Params {
+	return s.current.Load()
+}
+
+// Update publishes a copy of the current params as changed by f. The maps
+// in the copy are still shared with readers, f replaces them rather than
+// writing to them.
+func (s *paramStore) Update(f func(p *Params)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := *s.current.Load()
+	f(&p)
+	s.current.Store(&p)
 }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"strings"
+)
+
+// Pattern is a built-in stroke pattern played instead of a script. Tempo is
+// in strokes per minute, Min and Max are funscript positions (0-100).
+type Pattern struct {
+	Name  string  `json:"name"`
+	Tempo float64 `json:"tempo"`
+	Min   int     `json:"min"`
+	Max   int     `json:"max"`
+
+	// Fallback plays the pattern when a video has no script.
+	Fallback bool `json:"fallback"`
+}
+
+var defaultPattern = Pattern{
+	Name:  "sine",
+	Tempo: 60,
+	Min:   0,
+	Max:   100,
+}
+
+// patternFunc returns one loop of a pattern with strokes of period ms
+// between lo and hi. The last action is at the loop length and matches the
+// first so the loop is seamless.
+type patternFunc func(period, lo, hi float64) []FunscriptAction
+
+var patterns = map[string]patternFunc{
+	"sine":       patternSine,
+	"sawtooth":   patternSawtooth,
+	"random":     patternRandomWalk,
+	"pulse":      patternPulse,
+	"escalating": patternEscalating,
+}
+
+// patternNames lists the built-in patterns, sorted.
+func patternNames() []string {
+	names := make([]string, 0, len(patterns))
+	for name := range patterns {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func patternAction(at, pos float64) FunscriptAction {
+	return FunscriptAction{At: int(math.Round(at)), Pos: clampPos(pos)}
+}
+
+func patternSine(period, lo, hi float64) []FunscriptAction {
+	const steps = 8
+
+	actions := make([]FunscriptAction, 0, steps+1)
+
+	for i := 0; i <= steps; i++ {
+		phase := 2 * math.Pi * float64(i) / steps
+		actions = append(actions, patternAction(period*float64(i)/steps, lo+(hi-lo)*(1-math.Cos(phase))/2))
+	}
+
+	return actions
+}
+
+// patternSawtooth rises slowly and drops fast.
+func patternSawtooth(period, lo, hi float64) []FunscriptAction {
+	return []FunscriptAction{
+		patternAction(0, lo),
+		patternAction(period*0.8, hi),
+		patternAction(period, lo),
+	}
+}
+
+// patternPulse strokes quickly and rests for the rest of the period.
+func patternPulse(period, lo, hi float64) []FunscriptAction {
+	return []FunscriptAction{
+		patternAction(0, lo),
+		patternAction(period*0.15, hi),
+		patternAction(period*0.3, lo),
+		patternAction(period, lo),
+	}
+}
+
+// patternRandomWalk wanders up and down by up to half the range every half
+// stroke. The seed is fixed so the loop is the same every time.
+func patternRandomWalk(period, lo, hi float64) []FunscriptAction {
+	const steps = 64
+
+	rng := rand.New(rand.NewPCG(1, 2))
+	actions := make([]FunscriptAction, 0, steps+1)
+	pos := (lo + hi) / 2
+
+	for i := 0; i < steps; i++ {
+		actions = append(actions, patternAction(period/2*float64(i), pos))
+
+		step := (hi - lo) / 2 * rng.Float64()
+		if pos+step > hi || (pos-step >= lo && rng.IntN(2) == 0) {
+			step = -step
+		}
+
+		pos += step
+	}
+
+	return append(actions, patternAction(period/2*steps, float64(actions[0].Pos)))
+}
+
+// patternEscalating builds up from short slow strokes to full fast ones,
+// then starts over.
+func patternEscalating(period, lo, hi float64) []FunscriptAction {
+	const strokes = 16
+
+	actions := []FunscriptAction{patternAction(0, lo)}
+	at := 0.0
+
+	for i := 0; i < strokes; i++ {
+		progress := float64(i+1) / strokes
+		d := period * (1.5 - progress)
+
+		actions = append(actions, patternAction(at+d/2, lo+(hi-lo)*progress), patternAction(at+d, lo))
+		at += d
+	}
+
+	return actions
+}
+
+// Script renders one loop of the pattern as a looping stroke script.
+func (p Pattern) Script() (*Script, error) {
+	gen, ok := patterns[p.Name]
+	if !ok {
+		return nil, fmt.Errorf("unknown pattern %q, expected one of %s", p.Name, strings.Join(patternNames(), ", "))
+	}
+
+	if p.Tempo <= 0 {
+		return nil, fmt.Errorf("pattern tempo must be positive, got %g", p.Tempo)
+	}
+
+	if p.Min < 0 || p.Max > 100 || p.Min >= p.Max {
+		return nil, fmt.Errorf("pattern range %d-%d is not within 0-100", p.Min, p.Max)
+	}
+
+	s := axisMap[defaultAxis]
+
+	return &Script{
+		path:      "pattern:" + p.Name,
+		name:      defaultAxis,
+		filename:  p.Name,
+		generated: true,
+		loop:      true,
+		Axis:      s.Axis,
+		Channel:   s.Channel,
+		Actions:   gen(60000/p.Tempo, float64(p.Min), float64(p.Max)),
+	}, nil
+}
+
+// LoadPattern replaces the loaded scripts with a pattern on the stroke axis.
+// Generators derive the other axes from it like from any stroke script.
+func (s *Scripts) LoadPattern(p Pattern) error {
+	script, err := p.Script()
+	if err != nil {
+		return err
+	}
+
+	s.Reset()
+
+	s.pattern = true
+	s.variants[defaultAxis] = []*Script{script}
+	s.scripts[defaultAxis] = script
+
+	return nil
+}
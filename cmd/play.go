@@ -6,9 +6,9 @@ import (
 	"time"
 )
 
-func play(filename string) error {
+func play(devs Devices, filename string) error {
 	scripts := Scripts{
-		preferedModifier: ScriptModSoft,
+		preferred: params.Load().PreferredModifiers(),
 	}
 
 	err := scripts.Load(filename)
@@ -16,7 +16,14 @@ func play(filename string) error {
 		return fmt.Errorf("%s: %w", "scripts.Load", err)
 	}
 
-	tcode, err := scripts.TCode()
+	return playScripts(devs, &scripts)
+}
+
+// playScripts plays loaded scripts from the start until they end.
+func playScripts(devs Devices, scripts *Scripts) error {
+	devs.awaitInfo()
+
+	tcode, err := scripts.TCode(devs)
 	if err != nil {
 		return fmt.Errorf("%s: %w", "scripts.TCode", err)
 	}
@@ -30,10 +37,14 @@ func play(filename string) error {
 
 	tcode.Seek(time.Duration(0))
 
-	for msg := range tcode.Tick() {
-		err = sendTCode(msg)
+	// stop once every channel has played out, Reset closes the tick channel
+	end := time.AfterFunc(tcode.Duration()+time.Second, tcode.Reset)
+	defer end.Stop()
+
+	for frame := range tcode.Tick() {
+		err = frame.Send()
 		if err != nil {
-			return fmt.Errorf("%s: %w", "sendTCode", err)
+			return fmt.Errorf("%s: %w", "frame.Send", err)
 		}
 	}
 
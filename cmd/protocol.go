@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// https://github.com/multiaxis/tcode-spec
+
+const (
+	defaultPrecision = 5
+	maxPrecision     = 9
+)
+
+var (
+	errEmptyCommand   = errors.New("empty command")
+	errUnknownCommand = errors.New("unknown command")
+)
+
+// Command is a single parsed TCode command.
+type Command interface {
+	String() string
+}
+
+// DeviceCommand is a D command: D0 (name), D1 (tcode version), D2 (axis
+// list) or DSTOP.
+type DeviceCommand string
+
+const (
+	DeviceName    DeviceCommand = "D0"
+	DeviceVersion DeviceCommand = "D1"
+	DeviceAxes    DeviceCommand = "D2"
+	DeviceStop    DeviceCommand = "DSTOP"
+)
+
+func (d DeviceCommand) String() string {
+	return string(d)
+}
+
+// SaveCommand is a $ command that saves the min/max range of an axis, e.g.
+// $L0-1000-9000.
+type SaveCommand struct {
+	Axis    Axis
+	Channel int
+	Min     int
+	Max     int
+}
+
+func (s SaveCommand) String() string {
+	return fmt.Sprintf("$%s%d-%04d-%04d", s.Axis, s.Channel, s.Min, s.Max)
+}
+
+func isAxis(b byte) bool {
+	switch Axis(b) {
+	case AxisLinear, AxisRotary, AxisVibrate, AxisAlt:
+		return true
+	default:
+		return false
+	}
+}
+
+// encodeMagnitude writes value (0-1) as a fixed number of decimal digits,
+// truncating the rest. The epsilon keeps 0.99999 from becoming 99998.
+func encodeMagnitude(value float64, precision int) string {
+	if precision <= 0 {
+		precision = defaultPrecision
+	}
+
+	scale := math.Pow10(precision)
+	n := int64(math.Floor(value*scale + 1e-6))
+
+	if n < 0 {
+		n = 0
+	}
+
+	if n >= int64(scale) {
+		n = int64(scale) - 1
+	}
+
+	return fmt.Sprintf("%0*d", precision, n)
+}
+
+// ParseTCode parses a line of space (or comma) separated TCode commands.
+func ParseTCode(line string) ([]Command, error) {
+	fields := strings.FieldsFunc(line, func(r rune) bool {
+		return r == ' ' || r == ',' || r == '\t' || r == '\n' || r == '\r'
+	})
+
+	cmds := make([]Command, 0, len(fields))
+
+	for _, field := range fields {
+		cmd, err := ParseCommand(field)
+		if err != nil {
+			return nil, err
+		}
+
+		cmds = append(cmds, cmd)
+	}
+
+	return cmds, nil
+}
+
+// ParseCommand parses a single TCode command such as L09999I500, R05S100,
+// D1, DSTOP or $L0-1000-9000.
+func ParseCommand(s string) (Command, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+
+	if s == "" {
+		return nil, errEmptyCommand
+	}
+
+	switch {
+	case s[0] == 'D':
+		return parseDeviceCommand(s)
+	case s[0] == '$':
+		return parseSaveCommand(s)
+	case isAxis(s[0]):
+		return parseAxisCommand(s)
+	default:
+		return nil, fmt.Errorf("%w: %q", errUnknownCommand, s)
+	}
+}
+
+func parseDeviceCommand(s string) (Command, error) {
+	switch d := DeviceCommand(s); d {
+	case DeviceName, DeviceVersion, DeviceAxes, DeviceStop:
+		return d, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", errUnknownCommand, s)
+	}
+}
+
+func parseSaveCommand(s string) (Command, error) {
+	parts := strings.Split(s[1:], "-")
+	if len(parts) != 3 || len(parts[0]) != 2 || !isAxis(parts[0][0]) {
+		return nil, fmt.Errorf("invalid save command %q, expected $<axis><channel>-<min>-<max>", s)
+	}
+
+	channel, err := parseDigits(parts[0][1:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid channel in %q: %w", s, err)
+	}
+
+	lo, err := parseDigits(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid min in %q: %w", s, err)
+	}
+
+	hi, err := parseDigits(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid max in %q: %w", s, err)
+	}
+
+	return SaveCommand{
+		Axis:    Axis(parts[0][:1]),
+		Channel: channel,
+		Min:     lo,
+		Max:     hi,
+	}, nil
+}
+
+func parseAxisCommand(s string) (Command, error) {
+	if len(s) < 3 {
+		return nil, fmt.Errorf("invalid axis command %q, expected <axis><channel><magnitude>", s)
+	}
+
+	channel, err := parseDigits(s[1:2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid channel in %q: %w", s, err)
+	}
+
+	rest := s[2:]
+	magnitude := rest
+	modifier := ""
+
+	if i := strings.IndexAny(rest, "IS"); i >= 0 {
+		magnitude, modifier = rest[:i], rest[i:]
+	}
+
+	if magnitude == "" || len(magnitude) > maxPrecision {
+		return nil, fmt.Errorf("invalid magnitude in %q", s)
+	}
+
+	n, err := parseDigits(magnitude)
+	if err != nil {
+		return nil, fmt.Errorf("invalid magnitude in %q: %w", s, err)
+	}
+
+	msg := TCodeMessage{
+		Axis:      Axis(s[:1]),
+		Channel:   channel,
+		Value:     float64(n) / math.Pow10(len(magnitude)),
+		Precision: len(magnitude),
+	}
+
+	if modifier == "" {
+		return msg, nil
+	}
+
+	arg, err := parseDigits(modifier[1:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %c modifier in %q: %w", modifier[0], s, err)
+	}
+
+	switch modifier[0] {
+	case 'I':
+		msg.Duration = time.Duration(arg) * time.Millisecond
+	case 'S':
+		msg.Speed = arg
+	}
+
+	return msg, nil
+}
+
+func parseDigits(s string) (int, error) {
+	if s == "" {
+		return 0, errors.New("missing digits")
+	}
+
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return 0, fmt.Errorf("unexpected %q", r)
+		}
+	}
+
+	return strconv.Atoi(s)
+}
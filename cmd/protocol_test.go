@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCommandRoundTrip(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		cmd  Command
+	}{
+		{"L050", "L050", TCodeMessage{Axis: AxisLinear, Channel: 0, Value: 0.5, Precision: 2}},
+		{"L0999", "L0999", TCodeMessage{Axis: AxisLinear, Channel: 0, Value: 0.999, Precision: 3}},
+		{"R12500", "R12500", TCodeMessage{Axis: AxisRotary, Channel: 1, Value: 0.25, Precision: 4}},
+		{"V099999", "V099999", TCodeMessage{Axis: AxisVibrate, Channel: 0, Value: 0.99999, Precision: 5}},
+		{"a200001", "A200001", TCodeMessage{Axis: AxisAlt, Channel: 2, Value: 0.00001, Precision: 5}},
+		{"L09999I500", "L09999I500", TCodeMessage{Axis: AxisLinear, Channel: 0, Value: 0.9999, Precision: 4, Duration: 500 * time.Millisecond}},
+		{"R05S100", "R05S100", TCodeMessage{Axis: AxisRotary, Channel: 0, Value: 0.5, Precision: 1, Speed: 100}},
+		{"D0", "D0", DeviceName},
+		{"D1", "D1", DeviceVersion},
+		{"D2", "D2", DeviceAxes},
+		{"dstop", "DSTOP", DeviceStop},
+		{"$L0-1000-9000", "$L0-1000-9000", SaveCommand{Axis: AxisLinear, Channel: 0, Min: 1000, Max: 9000}},
+		{"$R1-0-9999", "$R1-0000-9999", SaveCommand{Axis: AxisRotary, Channel: 1, Min: 0, Max: 9999}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			cmd, err := ParseCommand(tt.in)
+			if err != nil {
+				t.Fatalf("ParseCommand(%q): %v", tt.in, err)
+			}
+
+			if cmd != tt.cmd {
+				t.Fatalf("ParseCommand(%q) = %#v, want %#v", tt.in, cmd, tt.cmd)
+			}
+
+			if got := cmd.String(); got != tt.want {
+				t.Fatalf("String() = %q, want %q", got, tt.want)
+			}
+
+			again, err := ParseCommand(cmd.String())
+			if err != nil {
+				t.Fatalf("ParseCommand(%q): %v", cmd.String(), err)
+			}
+
+			if again != cmd {
+				t.Fatalf("round trip of %q = %#v, want %#v", tt.in, again, cmd)
+			}
+		})
+	}
+}
+
+func TestParseCommandRejects(t *testing.T) {
+	tests := []string{
+		"",
+		"X050",         // bad axis
+		"L0",           // no magnitude
+		"L0I100",       // empty magnitude
+		"L05X10",       // unknown modifier
+		"L05I",         // modifier without a value
+		"LA50",         // bad channel
+		"L01234567890", // magnitude over the max precision
+		"D3",
+		"DSTART",
+		"$L0-1000",
+		"$X0-1000-9000",
+	}
+
+	for _, in := range tests {
+		_, err := ParseCommand(in)
+		if err == nil {
+			t.Errorf("ParseCommand(%q) succeeded, want an error", in)
+		}
+	}
+}
+
+func TestParseTCode(t *testing.T) {
+	cmds, err := ParseTCode("L09999I500 R05, DSTOP\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"L09999I500", "R05", "DSTOP"}
+	if len(cmds) != len(want) {
+		t.Fatalf("got %d commands, want %d", len(cmds), len(want))
+	}
+
+	for i, cmd := range cmds {
+		if cmd.String() != want[i] {
+			t.Errorf("command %d = %q, want %q", i, cmd.String(), want[i])
+		}
+	}
+
+	_, err = ParseTCode("L05 X05")
+	if err == nil {
+		t.Error("ParseTCode accepted a bad command")
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	statsBucketSize = 100         // units/s per histogram bucket
+	statsBuckets    = 7           // the last bucket is open ended
+	statsIdleSpeed  = 1.0         // units/s below which the script is idle
+	statsMinIdle    = time.Second // shorter pauses aren't reported
+	statsTopGaps    = 5
+)
+
+// statsThresholds are the speeds the time-above percentages are reported
+// for.
+var statsThresholds = []int{200, 400, 600}
+
+type SpeedBucket struct {
+	Min     int     `json:"min"`
+	Max     int     `json:"max,omitempty"` // 0 for the open ended bucket
+	Percent float64 `json:"percent"`
+}
+
+type IdleGap struct {
+	Start int `json:"start"` // ms
+	End   int `json:"end"`   // ms
+}
+
+func (g IdleGap) Duration() time.Duration {
+	return time.Duration(g.End-g.Start) * time.Millisecond
+}
+
+type ScriptStats struct {
+	Path         string          `json:"path"`
+	Duration     int             `json:"duration"` // ms
+	Actions      int             `json:"actions"`
+	Strokes      int             `json:"strokes"`
+	AverageSpeed float64         `json:"averageSpeed"` // units/s while moving
+	PeakSpeed    float64         `json:"peakSpeed"`    // units/s
+	Histogram    []SpeedBucket   `json:"histogram"`    // share of moving time
+	Above        map[int]float64 `json:"above"`        // percent of the script above each speed
+	IdleGaps     []IdleGap       `json:"idleGaps"`
+}
+
+// scriptStats summarizes a script's actions. Speeds are computed per
+// segment between consecutive actions with getSpeed, as in the heatmap.
+func scriptStats(script Script) ScriptStats {
+	actions := append([]FunscriptAction{}, script.Actions...)
+
+	sort.SliceStable(actions, func(i, j int) bool {
+		return actions[i].At < actions[j].At
+	})
+
+	stats := ScriptStats{
+		Path:      script.path,
+		Actions:   len(actions),
+		Histogram: make([]SpeedBucket, statsBuckets),
+		Above:     map[int]float64{},
+		IdleGaps:  []IdleGap{},
+	}
+
+	for i := range stats.Histogram {
+		stats.Histogram[i].Min = i * statsBucketSize
+
+		if i < statsBuckets-1 {
+			stats.Histogram[i].Max = (i + 1) * statsBucketSize
+		}
+	}
+
+	for _, t := range statsThresholds {
+		stats.Above[t] = 0
+	}
+
+	if len(actions) == 0 {
+		return stats
+	}
+
+	// the script starts at 0, not at its first action
+	stats.Duration = actions[len(actions)-1].At
+
+	var (
+		moving    float64 // ms spent moving
+		distance  float64
+		direction int
+		runs      int // runs of movement in one direction
+		idle      *IdleGap
+	)
+
+	if actions[0].At > 0 {
+		idle = &IdleGap{Start: 0, End: actions[0].At}
+	}
+
+	above := map[int]float64{}
+
+	for i := 1; i < len(actions); i++ {
+		a1, a2 := actions[i-1], actions[i]
+		dt := float64(a2.At - a1.At)
+
+		if dt <= 0 {
+			continue
+		}
+
+		speed := getSpeed(a1, a2)
+
+		if speed < statsIdleSpeed {
+			if idle == nil {
+				idle = &IdleGap{Start: a1.At}
+			}
+
+			idle.End = a2.At
+
+			continue
+		}
+
+		if idle != nil {
+			stats.IdleGaps = append(stats.IdleGaps, *idle)
+			idle = nil
+		}
+
+		moving += dt
+		distance += math.Abs(float64(a2.Pos - a1.Pos))
+		stats.PeakSpeed = math.Max(stats.PeakSpeed, speed)
+
+		bucket := min(int(speed)/statsBucketSize, statsBuckets-1)
+		stats.Histogram[bucket].Percent += dt
+
+		for _, t := range statsThresholds {
+			if speed > float64(t) {
+				above[t] += dt
+			}
+		}
+
+		dir := 1
+		if a2.Pos < a1.Pos {
+			dir = -1
+		}
+
+		if dir != direction {
+			runs++
+			direction = dir
+		}
+	}
+
+	// a stroke is a run up and a run down, a trailing half stroke counts
+	stats.Strokes = (runs + 1) / 2
+
+	if idle != nil {
+		stats.IdleGaps = append(stats.IdleGaps, *idle)
+	}
+
+	if moving > 0 {
+		stats.AverageSpeed = distance / moving * 1000
+
+		for i := range stats.Histogram {
+			stats.Histogram[i].Percent = stats.Histogram[i].Percent / moving * 100
+		}
+	}
+
+	if stats.Duration > 0 {
+		for t, ms := range above {
+			stats.Above[t] = ms / float64(stats.Duration) * 100
+		}
+	}
+
+	gaps := stats.IdleGaps[:0]
+
+	for _, g := range stats.IdleGaps {
+		if g.Duration() >= statsMinIdle {
+			gaps = append(gaps, g)
+		}
+	}
+
+	sort.SliceStable(gaps, func(i, j int) bool {
+		return gaps[i].Duration() > gaps[j].Duration()
+	})
+
+	if len(gaps) > statsTopGaps {
+		gaps = gaps[:statsTopGaps]
+	}
+
+	stats.IdleGaps = gaps
+
+	return stats
+}
+
+func formatMs(n int) string {
+	return (time.Duration(n) * time.Millisecond).String()
+}
+
+func writeStatsText(w io.Writer, s ScriptStats) error {
+	lines := []string{
+		fmt.Sprintf("script:        %s", s.Path),
+		fmt.Sprintf("duration:      %s", formatMs(s.Duration)),
+		fmt.Sprintf("actions:       %d", s.Actions),
+		fmt.Sprintf("strokes:       %d", s.Strokes),
+		fmt.Sprintf("average speed: %.0f units/s", s.AverageSpeed),
+		fmt.Sprintf("peak speed:    %.0f units/s", s.PeakSpeed),
+		"intensity:",
+	}
+
+	for _, b := range s.Histogram {
+		label := fmt.Sprintf("%d-%d", b.Min, b.Max)
+		if b.Max == 0 {
+			label = fmt.Sprintf("%d+", b.Min)
+		}
+
+		bar := strings.Repeat("#", int(math.Round(b.Percent/2)))
+		lines = append(lines, fmt.Sprintf("  %-8s %5.1f%% %s", label, b.Percent, bar))
+	}
+
+	lines = append(lines, "time above:")
+
+	for _, t := range statsThresholds {
+		lines = append(lines, fmt.Sprintf("  %d units/s: %.1f%%", t, s.Above[t]))
+	}
+
+	if len(s.IdleGaps) > 0 {
+		lines = append(lines, "longest idle gaps:")
+
+		for _, g := range s.IdleGaps {
+			lines = append(lines, fmt.Sprintf("  %s - %s (%s)", formatMs(g.Start), formatMs(g.End), g.Duration()))
+		}
+	}
+
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+
+	return err
+}
+
+// stats prints statistics for a script as text or json.
+func stats(w io.Writer, path string, format string) error {
+	script, err := NewScript(path)
+	if err != nil {
+		return err
+	}
+
+	s := scriptStats(*script)
+
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		return enc.Encode(s)
+	case "text":
+		return writeStatsText(w, s)
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"fmt"
 	"math"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -21,11 +23,16 @@ const (
 	AxisAlt     Axis = "A"
 )
 
+// TCodeMessage is an axis command. Duration (I) and Speed (S) are mutually
+// exclusive, Duration wins if both are set. Precision is the number of
+// magnitude digits, 5 if unset.
 type TCodeMessage struct {
-	Axis     Axis
-	Channel  int
-	Value    float64
-	Duration time.Duration
+	Axis      Axis
+	Channel   int
+	Value     float64
+	Duration  time.Duration
+	Speed     int
+	Precision int
 }
 
 func (tm TCodeMessage) String() string {
@@ -33,36 +40,47 @@ func (tm TCodeMessage) String() string {
 		return ""
 	}
 
-	var pos string
+	pos := encodeMagnitude(tm.Value, tm.Precision)
 
-	switch tm.Value {
-	case 0.0:
-		pos = "00000"
-	case 1.0:
-		pos = "99999"
+	switch {
+	case tm.Duration > 0:
+		return fmt.Sprintf("%s%d%sI%d", tm.Axis, tm.Channel, pos, tm.Duration.Milliseconds())
+	case tm.Speed > 0:
+		return fmt.Sprintf("%s%d%sS%d", tm.Axis, tm.Channel, pos, tm.Speed)
 	default:
-		pos = fmt.Sprintf("%f", tm.Value)[2:]
-
-		if len(pos) > 5 {
-			pos = pos[:5]
-		} else if len(pos) < 5 {
-			pos = fmt.Sprintf("%05s", pos)
-		}
+		return fmt.Sprintf("%s%d%s", tm.Axis, tm.Channel, pos)
 	}
+}
 
-	if tm.Duration == 0 {
-		return fmt.Sprintf("%s%d%s", tm.Axis, tm.Channel, pos)
+// ID is the axis and channel, e.g. L0.
+func (tm TCodeMessage) ID() string {
+	return fmt.Sprintf("%s%d", tm.Axis, tm.Channel)
+}
+
+// Frame is one tick of output: the tcode line for each device.
+type Frame map[Device]string
+
+func (f Frame) Send() error {
+	for dev, msg := range f {
+		err := sendTCode(dev, msg)
+		if err != nil {
+			return err
+		}
 	}
 
-	return fmt.Sprintf("%s%d%sI%d", tm.Axis, tm.Channel, pos, tm.Duration.Milliseconds())
+	return nil
 }
 
 type TCode struct {
+	mu       sync.Mutex
 	channels []channel
 
-	messages chan string
-	ts       time.Duration
+	messages chan Frame
+	clock    *Clock
 	ticker   *time.Ticker
+
+	// parked is set when the axes were moved away from the script
+	parked bool
 }
 
 type spline interface {
@@ -73,10 +91,15 @@ type spline interface {
 }
 
 func PointFromSpline(s spline, pos float64, bottom, top float64) float64 {
+	return scalePosition(s.Predict(pos), bottom, top)
+}
+
+// scalePosition maps a funscript position (0-100) to a tcode value (0-1).
+func scalePosition(pos float64, bottom, top float64) float64 {
 	d := 100.0
 	v := d + (bottom+top)*2
 
-	point := (s.Predict(pos) / v) + (bottom / d)
+	point := (pos / v) + (bottom / d)
 
 	if point < 0.0 {
 		return 0.0
@@ -92,32 +115,239 @@ func PointFromSpline(s spline, pos float64, bottom, top float64) float64 {
 type channel struct {
 	axis     Axis
 	channel  int
+	device   Device
 	spline   spline
 	duration int
 
+	// sorted action times and positions the spline was fit to
+	xs, ys []float64
+
 	maxOffset int
 	minOffset int
+
+	// loop is the length in ms of a channel that repeats, 0 if it doesn't
+	loop int
+}
+
+func (c channel) id() string {
+	return fmt.Sprintf("%s%d", c.axis, c.channel)
+}
+
+// scriptTime is the time in the script in ms at playback position now,
+// after the axis offset in p and wrapped around for looping channels.
+func (c channel) scriptTime(p *Params, now time.Duration) float64 {
+	ms := float64((now - p.OffsetFor(c.id())).Milliseconds())
+
+	if c.loop > 0 {
+		ms = math.Mod(ms, float64(c.loop))
+		if ms < 0 {
+			ms += float64(c.loop)
+		}
+	}
+
+	return ms
+}
+
+// next returns the index of the first action after ms.
+func (c channel) next(ms float64) int {
+	return sort.Search(len(c.xs), func(i int) bool {
+		return c.xs[i] > ms
+	})
+}
+
+// rateMinInterval is the shortest time in ms between actions sent in the
+// action modes when playing faster than 1x, closer actions are skipped.
+const rateMinInterval = 50
+
+// rateMaxSpeed is the speed in units/s moves are slowed down to when
+// playing faster than 1x, where scripts get faster than a device can
+// follow. The limiter's velocity applies on top of it.
+const rateMaxSpeed = 600
+
+// valueSpeed converts a speed in funscript units/s to tcode values/s at the
+// min and max in p.
+func valueSpeed(p *Params, speed float64) float64 {
+	return speed * (scalePosition(100, p.Min, p.Max) - scalePosition(0, p.Min, p.Max)) / 100
+}
+
+// actionMessage moves the axis from position from (0-100) to action i so
+// it arrives on time at rate, leaving the interpolation to the firmware as
+// p.Mode says. Above 1x moves are slowed down to rateMaxSpeed if they'd be
+// faster. It also returns how long the move takes in ms.
+func (c channel) actionMessage(p *Params, i int, ms, from, rate float64) (TCodeMessage, float64) {
+	msg := TCodeMessage{
+		Axis:    c.axis,
+		Channel: c.channel,
+		Value:   scalePosition(c.ys[i], p.Min, p.Max),
+	}
+
+	dt := (c.xs[i] - ms) / rate
+	if dt <= 0 {
+		return msg, 0
+	}
+
+	if rate > 1 {
+		dt = max(dt, math.Abs(c.ys[i]-from)/rateMaxSpeed*1000)
+	}
+
+	switch p.Mode {
+	case ModeSpeed:
+		// speed is in units of 1/10000 of the range per 100ms
+		dist := math.Abs(msg.Value - scalePosition(from, p.Min, p.Max))
+		msg.Speed = max(1, int(dist*10000/(dt/100)))
+	default:
+		msg.Duration = time.Duration(dt) * time.Millisecond
+	}
+
+	return msg, dt
+}
+
+// segment is the action a channel is moving to in the action modes. Above
+// 1x the target can be past next when actions were thinned out, and the
+// move can last until after the target's time when it was slowed down.
+type segment struct {
+	next, target int
+	until        float64 // script time in ms the move ends
+}
+
+// heading reports whether the channel is still on its way to the target
+// at ms, when next is the upcoming action.
+func (s segment) heading(next int, ms float64) bool {
+	return next == s.next || (next > s.next && (next <= s.target || ms < s.until))
+}
+
+// thin picks the action to move to when playing faster than 1x: of the
+// upcoming actions too close together to follow, the one furthest from
+// where the axis is, so strokes aren't lost to the skipping.
+func (c channel) thin(next int, ms, from, rate float64) int {
+	target := next
+
+	for j := next + 1; j < len(c.xs) && (c.xs[j-1]-ms)/rate < rateMinInterval; j++ {
+		if math.Abs(c.ys[j]-from) > math.Abs(c.ys[target]-from) {
+			target = j
+		}
+	}
+
+	return target
+}
+
+// seekRampMin is the shortest ramp to a seek.
+const seekRampMin = 200 * time.Millisecond
+
+// rampIterations bounds how often a ramp is retargeted to where the script
+// will be once it's done.
+const rampIterations = 8
+
+// rampMessages move every channel to where the script will be when the ramp
+// ends, with an I interval long enough to stay under the ramp speed, so
+// playback carries on from there without a jump. All channels arrive
+// together. A channel that hasn't sent anything yet is assumed to be a full
+// stroke away. It returns the messages and how long the ramp takes.
+func rampMessages(p *Params, channels []channel, now time.Duration, rate float64, values map[int]float64) (map[Device][]string, time.Duration) {
+	speed := valueSpeed(p, p.Clock.RampSpeed)
+	d := seekRampMin
+	targets := map[int]float64{}
+
+	// the further the ramp goes, the longer it takes and the further the
+	// script moves on in the meantime
+	for i := 0; ; i++ {
+		at := now + time.Duration(float64(d)*rate)
+		dist := 0.0
+
+		for i, c := range channels {
+			if c.spline == nil {
+				continue
+			}
+
+			targets[i] = PointFromSpline(c.spline, c.scriptTime(p, at), p.Min, p.Max)
+
+			if v, ok := values[i]; ok {
+				dist = math.Max(dist, math.Abs(targets[i]-v))
+			} else {
+				dist = 1
+			}
+		}
+
+		need := time.Duration(dist / speed * float64(time.Second))
+		if need <= d || i == rampIterations-1 {
+			break
+		}
+
+		d = need
+	}
+
+	messages := map[Device][]string{}
+
+	for i, c := range channels {
+		value, ok := targets[i]
+		if !ok {
+			continue
+		}
+
+		values[i] = value
+
+		msg := TCodeMessage{Axis: c.axis, Channel: c.channel, Value: value, Duration: d}
+		messages[c.device] = append(messages[c.device], msg.String())
+	}
+
+	return messages, d
 }
 
 func NewTCode() *TCode {
 	tc = &TCode{
-		ts:     0,
+		clock:  NewClock(params.Load().Rate),
 		ticker: time.NewTicker(TPS),
 	}
 
+	tc.clock.Resume()
+
 	return tc
 }
 
+// Channels returns the channels currently playing.
+func (t *TCode) Channels() []channel {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.channels
+}
+
+// SetChannels swaps the playing channels without interrupting playback.
+func (t *TCode) SetChannels(channels []channel) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.channels = channels
+}
+
+// Duration is the length of the longest loaded channel.
+func (t *TCode) Duration() time.Duration {
+	if t == nil {
+		return 0
+	}
+
+	var longest int
+
+	for _, c := range t.Channels() {
+		if c.duration > longest {
+			longest = c.duration
+		}
+	}
+
+	return time.Duration(longest) * time.Millisecond
+}
+
 func (t *TCode) Pause() {
 	if t == nil {
 		return
 	}
 
-	t.setValue(params.Min, time.Second)
+	t.setValue(params.Load().Min, time.Second)
 
 	log.Debug().Msg("pause")
 
 	t.ticker.Reset(math.MaxInt64)
+	t.clock.Pause()
 }
 
 func (t *TCode) Play() {
@@ -127,9 +357,11 @@ func (t *TCode) Play() {
 
 	log.Debug().Msg("play")
 
+	t.clock.Resume()
 	t.ticker.Reset(TPS)
 }
 
+// Seek jumps to a new position.
 func (t *TCode) Seek(seek time.Duration) {
 	if t == nil {
 		return
@@ -137,65 +369,171 @@ func (t *TCode) Seek(seek time.Duration) {
 
 	log.Trace().Dur("seek", seek).Msg("seek")
 
-	t.ts = seek
+	t.clock.Set(seek)
+}
+
+// Sync eases the playback clock towards the position the host reports.
+func (t *TCode) Sync(pos time.Duration) {
+	if t == nil {
+		return
+	}
+
+	t.clock.Sync(pos)
 }
 
-func (t *TCode) Tick() <-chan string {
+func (t *TCode) Tick() <-chan Frame {
 	if t == nil {
 		return nil
 	}
 
-	messages := make(chan string)
+	frames := make(chan Frame)
 
-	t.messages = messages
+	t.messages = frames
 
 	go func() {
 		defer func() {
 			_ = recover() // don't panic if channel is closed
 		}()
 
-		last := ""
+		last := map[Device]string{}
+		segments := map[int]segment{} // action per channel in action modes
+		values := map[int]float64{}   // last value sent per channel
 
-		t.ticker.Reset(TPS)
+		var (
+			prev      []channel
+			rampUntil time.Time
+		)
 
-		for range t.ticker.C {
-			var messages []string
+		send := func(messages map[Device][]string) {
+			frame := Frame{}
+
+			for dev, msgs := range messages {
+				msg := strings.Join(msgs, ", ")
+
+				// a position the limiter held back has to be sent again
+				if msg == last[dev] && !limiter.Limiting(dev) {
+					log.Trace().Str("tcode", msg).Msg("skip duplicate")
 
-			for _, c := range t.channels {
-				if c.spline == nil {
 					continue
 				}
 
-				pos := PointFromSpline(c.spline, float64(t.ts.Milliseconds()), params.Min, params.Max)
-				msg := TCodeMessage{
-					Axis:    c.axis,
-					Channel: c.channel,
-					Value:   pos,
-				}
+				last[dev] = msg
+				frame[dev] = msg
+			}
 
-				messages = append(messages, msg.String())
+			if len(frame) == 0 {
+				return
 			}
 
-			t.ts += TPS
+			t.messages <- frame
+		}
 
-			if len(messages) == 0 {
-				continue
+		t.ticker.Reset(TPS)
+
+		for range t.ticker.C {
+			messages := map[Device][]string{}
+			p := params.Load()
+
+			channels := t.Channels()
+			if len(channels) != len(prev) || (len(channels) > 0 && &channels[0] != &prev[0]) {
+				// channels were swapped
+				clear(segments)
+				clear(values)
+			}
+
+			prev = channels
+			now := t.clock.Position()
+			rate := t.clock.Rate()
+
+			// ease into a seek, or back from where the axes were parked,
+			// rather than jumping there at full speed
+			jump, jumped := t.clock.Jumped()
+
+			parked := t.unpark()
+			if parked {
+				clear(values)
 			}
 
-			msg := strings.Join(messages, ", ")
+			if p.Clock.Ramp > 0 && p.Clock.RampSpeed > 0 &&
+				(parked || (jumped && jump.Abs() > time.Duration(p.Clock.Ramp)*time.Millisecond)) {
+				var d time.Duration
+
+				messages, d = rampMessages(p, channels, now, rate, values)
+				rampUntil = time.Now().Add(d)
+				clear(segments)
+
+				log.Debug().Dur("jump", jump).Bool("parked", parked).Dur("ramp", d).Msg("ramping to script")
 
-			if msg == last {
-				log.Trace().Str("tcode", msg).Msg("skip duplicate")
+				send(messages)
 
 				continue
 			}
 
-			last = msg
-			t.messages <- last
+			if time.Now().Before(rampUntil) {
+				continue
+			}
+
+			for i, c := range channels {
+				if c.spline == nil {
+					continue
+				}
+
+				ms := c.scriptTime(p, now)
+
+				var msg TCodeMessage
+
+				if p.Mode == ModeTick {
+					value := PointFromSpline(c.spline, ms, p.Min, p.Max)
+
+					// fast forward speeds the script up, clamp it to what
+					// the device can do
+					if v, ok := values[i]; ok && rate > 1 {
+						step := valueSpeed(p, rateMaxSpeed) * TPS.Seconds()
+						value = v + max(-step, min(step, value-v))
+					}
+
+					values[i] = value
+
+					msg = TCodeMessage{
+						Axis:    c.axis,
+						Channel: c.channel,
+						Value:   value,
+					}
+				} else {
+					next := c.next(ms)
+
+					seg, ok := segments[i]
+					if (ok && seg.heading(next, ms)) || next >= len(c.xs) {
+						continue
+					}
+
+					// the axis is where the last move ended, or on the
+					// script if there was none or we seeked back
+					from := c.spline.Predict(ms)
+					if ok && next > seg.next {
+						from = c.ys[seg.target]
+					}
+
+					target := next
+					if rate > 1 {
+						target = c.thin(next, ms, from, rate)
+					}
+
+					var dt float64
+
+					msg, dt = c.actionMessage(p, target, ms, from, rate)
+					segments[i] = segment{next: next, target: target, until: ms + dt*rate}
+					values[i] = msg.Value
+				}
+
+				messages[c.device] = append(messages[c.device], msg.String())
+			}
+
+			send(messages)
 		}
 	}()
 
-	return messages
+	return frames
 }
 
 func (t *TCode) setValue(value float64, duration time.Duration) {
@@ -203,8 +541,8 @@ func (t *TCode) setValue(value float64, duration time.Duration) {
 		return
 	}
 
-	for _, c := range t.channels {
-		err := sendTCode((TCodeMessage{
+	for _, c := range t.Channels() {
+		err := sendTCode(c.device, (TCodeMessage{
 			Axis:     c.axis,
 			Channel:  c.channel,
 			Value:    value,
@@ -216,12 +554,71 @@ func (t *TCode) setValue(value float64, duration time.Duration) {
 	}
 }
 
+// parkTime is how long parking the axes takes.
+const parkTime = time.Second
+
+// parkMessage moves an axis to rest: the stroke to the bottom of the range
+// in p, other positional axes to the middle, vibrate and auxiliary axes off.
+func parkMessage(p *Params, axis Axis, channel int) TCodeMessage {
+	msg := TCodeMessage{Axis: axis, Channel: channel, Duration: parkTime}
+
+	switch {
+	case axis == AxisLinear && channel == 0:
+		msg.Value = scalePosition(0, p.Min, p.Max)
+	case axis == AxisLinear || axis == AxisRotary:
+		msg.Value = 0.5
+	default:
+		msg.Duration = 0
+	}
+
+	return msg
+}
+
+// Park moves the channels on devices that didn't report their axes to
+// rest, Devices.Park takes care of the others, and has playback ramp back
+// to the script afterwards.
+func (t *TCode) Park() {
+	if t == nil {
+		return
+	}
+
+	p := params.Load()
+
+	for _, c := range t.Channels() {
+		if len(c.device.Info().Axes) > 0 {
+			continue
+		}
+
+		err := sendTCode(c.device, parkMessage(p, c.axis, c.channel).String())
+		if err != nil {
+			log.Error().Err(err).Msg("failed to send tcode")
+		}
+	}
+
+	t.mu.Lock()
+	t.parked = true
+	t.mu.Unlock()
+}
+
+// unpark reports, once, whether the axes were parked since it was last
+// asked.
+func (t *TCode) unpark() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	parked := t.parked
+	t.parked = false
+
+	return parked
+}
+
 func (t *TCode) Stop() {
 	if t == nil {
 		return
 	}
 
 	t.ticker.Reset(math.MaxInt64)
+	t.clock.Pause()
 }
 
 func (t *TCode) Reset() {
@@ -231,11 +628,15 @@ func (t *TCode) Reset() {
 
 	t.Stop()
 
+	if s := t.clock.Stats(); s.Syncs > 0 {
+		log.Info().Any("drift", s).Msg("playback clock drift")
+	}
+
 	if t.messages != nil {
 		close(t.messages)
 	}
 
-	t.channels = nil
+	t.SetChannels(nil)
 	t.messages = nil
 }
 
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Transform is one step of a transform pipeline. Transforms expect actions
+// sorted by time with positions in 0-100 and return a new slice, the input
+// is never modified.
+type Transform func([]FunscriptAction) []FunscriptAction
+
+// Pipeline applies its transforms in order.
+type Pipeline []Transform
+
+func (p Pipeline) Apply(actions []FunscriptAction) []FunscriptAction {
+	actions = sortActions(actions)
+
+	for _, t := range p {
+		actions = t(actions)
+	}
+
+	return actions
+}
+
+func sortActions(actions []FunscriptAction) []FunscriptAction {
+	sorted := append([]FunscriptAction{}, actions...)
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].At < sorted[j].At
+	})
+
+	return sorted
+}
+
+func clampPos(pos float64) int {
+	return int(math.Round(math.Max(0, math.Min(100, pos))))
+}
+
+// Shift moves every action by ms, actions that end up before the start are
+// dropped.
+func Shift(ms int) Transform {
+	return func(actions []FunscriptAction) []FunscriptAction {
+		shifted := make([]FunscriptAction, 0, len(actions))
+
+		for _, a := range actions {
+			if a.At+ms < 0 {
+				continue
+			}
+
+			shifted = append(shifted, FunscriptAction{At: a.At + ms, Pos: a.Pos})
+		}
+
+		return shifted
+	}
+}
+
+// Remap maps positions from 0-100 to lo-hi. A curve of 1 is linear, above 1
+// spends more of the stroke near lo and below 1 more near hi.
+func Remap(lo, hi int, curve float64) Transform {
+	return func(actions []FunscriptAction) []FunscriptAction {
+		remapped := make([]FunscriptAction, 0, len(actions))
+
+		for _, a := range actions {
+			p := math.Pow(math.Max(0, math.Min(1, float64(a.Pos)/100)), curve)
+
+			remapped = append(remapped, FunscriptAction{
+				At:  a.At,
+				Pos: clampPos(float64(lo) + p*float64(hi-lo)),
+			})
+		}
+
+		return remapped
+	}
+}
+
+// Invert flips positions, 0 becomes 100.
+func Invert() Transform {
+	return func(actions []FunscriptAction) []FunscriptAction {
+		inverted := make([]FunscriptAction, 0, len(actions))
+
+		for _, a := range actions {
+			inverted = append(inverted, FunscriptAction{At: a.At, Pos: 100 - a.Pos})
+		}
+
+		return inverted
+	}
+}
+
+// LimitSpeed shortens strokes faster than maxSpeed units/s so they only
+// travel as far as the limit allows in the time they have. Each stroke
+// starts from where the previous, possibly shortened, one ended.
+func LimitSpeed(maxSpeed float64) Transform {
+	return func(actions []FunscriptAction) []FunscriptAction {
+		limited := make([]FunscriptAction, 0, len(actions))
+
+		for i, a := range actions {
+			if i == 0 {
+				limited = append(limited, a)
+
+				continue
+			}
+
+			prev := limited[len(limited)-1]
+			if getSpeed(prev, a) > maxSpeed {
+				reach := maxSpeed * float64(a.At-prev.At) / 1000
+				if a.Pos < prev.Pos {
+					reach = -reach
+				}
+
+				a.Pos = clampPos(float64(prev.Pos) + reach)
+			}
+
+			limited = append(limited, a)
+		}
+
+		return limited
+	}
+}
+
+// Simplify drops actions with Ramer-Douglas-Peucker. An action is kept if
+// it's more than epsilon position units away from the line between the
+// actions kept around it, measured at its time.
+func Simplify(epsilon float64) Transform {
+	return func(actions []FunscriptAction) []FunscriptAction {
+		if len(actions) < 3 {
+			return append([]FunscriptAction{}, actions...)
+		}
+
+		keep := make([]bool, len(actions))
+		keep[0], keep[len(actions)-1] = true, true
+
+		var rdp func(first, last int)
+		rdp = func(first, last int) {
+			a1, a2 := actions[first], actions[last]
+
+			index, dist := -1, epsilon
+
+			for i := first + 1; i < last; i++ {
+				pos := float64(a1.Pos)
+				if a2.At != a1.At {
+					pos += float64(a2.Pos-a1.Pos) * float64(actions[i].At-a1.At) / float64(a2.At-a1.At)
+				}
+
+				if d := math.Abs(float64(actions[i].Pos) - pos); d > dist {
+					index, dist = i, d
+				}
+			}
+
+			if index < 0 {
+				return
+			}
+
+			keep[index] = true
+			rdp(first, index)
+			rdp(index, last)
+		}
+
+		rdp(0, len(actions)-1)
+
+		simplified := make([]FunscriptAction, 0, len(actions))
+
+		for i, a := range actions {
+			if keep[i] {
+				simplified = append(simplified, a)
+			}
+		}
+
+		return simplified
+	}
+}
+
+// MinInterval drops actions less than ms after the last kept one.
+func MinInterval(ms int) Transform {
+	return func(actions []FunscriptAction) []FunscriptAction {
+		filtered := make([]FunscriptAction, 0, len(actions))
+
+		for _, a := range actions {
+			if len(filtered) > 0 && a.At-filtered[len(filtered)-1].At < ms {
+				continue
+			}
+
+			filtered = append(filtered, a)
+		}
+
+		return filtered
+	}
+}
+
+// ParseTransform parses a transform step given on the command line:
+//
+//	shift=<ms>
+//	remap=<lo>:<hi>[:<curve>]
+//	invert
+//	limit=<units/s>
+//	simplify=<epsilon>
+//	min-interval=<ms>
+func ParseTransform(step string) (Transform, error) {
+	name, arg, _ := strings.Cut(step, "=")
+
+	var args []float64
+
+	if arg != "" {
+		for _, s := range strings.Split(arg, ":") {
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid argument %q to %s: %w", s, name, err)
+			}
+
+			args = append(args, f)
+		}
+	}
+
+	want := func(n ...int) error {
+		for _, m := range n {
+			if len(args) == m {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("wrong number of arguments to %s: %d", name, len(args))
+	}
+
+	switch name {
+	case "shift":
+		if err := want(1); err != nil {
+			return nil, err
+		}
+
+		return Shift(int(args[0])), nil
+	case "remap":
+		if err := want(2, 3); err != nil {
+			return nil, err
+		}
+
+		curve := 1.0
+		if len(args) == 3 {
+			curve = args[2]
+		}
+
+		if curve <= 0 {
+			return nil, fmt.Errorf("remap curve must be positive, got %g", curve)
+		}
+
+		return Remap(int(args[0]), int(args[1]), curve), nil
+	case "invert":
+		if err := want(0); err != nil {
+			return nil, err
+		}
+
+		return Invert(), nil
+	case "limit":
+		if err := want(1); err != nil {
+			return nil, err
+		}
+
+		if args[0] <= 0 {
+			return nil, fmt.Errorf("limit must be positive, got %g", args[0])
+		}
+
+		return LimitSpeed(args[0]), nil
+	case "simplify":
+		if err := want(1); err != nil {
+			return nil, err
+		}
+
+		return Simplify(args[0]), nil
+	case "min-interval":
+		if err := want(1); err != nil {
+			return nil, err
+		}
+
+		return MinInterval(int(args[0])), nil
+	default:
+		return nil, fmt.Errorf("unknown transform %q", name)
+	}
+}
+
+// normalizeActions scales actions from a script range to 0-100.
+func normalizeActions(actions []FunscriptAction, scriptRange int) []FunscriptAction {
+	if scriptRange <= 0 || scriptRange == 100 {
+		return actions
+	}
+
+	s := Script{Range: scriptRange}
+	normalized := make([]FunscriptAction, 0, len(actions))
+
+	for _, a := range actions {
+		normalized = append(normalized, FunscriptAction{At: a.At, Pos: clampPos(s.normalize(a.Pos, false))})
+	}
+
+	return normalized
+}
+
+// transform runs steps over a script and each of its embedded axes and
+// writes the result to out. Positions are scaled to 0-100 first, so the
+// written script's range is 100.
+func transform(w io.Writer, path, out string, steps []string) error {
+	pipeline := make(Pipeline, 0, len(steps))
+
+	for _, step := range steps {
+		t, err := ParseTransform(step)
+		if err != nil {
+			return err
+		}
+
+		pipeline = append(pipeline, t)
+	}
+
+	script, err := NewScript(path)
+	if err != nil {
+		return err
+	}
+
+	before, scriptRange := len(script.Actions), script.Range
+
+	script.Actions = pipeline.Apply(normalizeActions(script.Actions, scriptRange))
+	script.Range = 100
+
+	// axes without a range of their own inherit the script's
+	for i, a := range script.Axes {
+		axisRange := a.Range
+		if axisRange == 0 {
+			axisRange = scriptRange
+		}
+
+		script.Axes[i].Actions = pipeline.Apply(normalizeActions(a.Actions, axisRange))
+		script.Axes[i].Range = 0
+	}
+
+	err = writeScript(out, script)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "wrote %s: %d actions (was %d)\n", out, len(script.Actions), before)
+
+	return err
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const dialTimeout = 5 * time.Second
+
+type transportOpener func(u *url.URL, baud uint) (io.ReadWriteCloser, error)
+
+// transports maps the scheme of a device address to the code that opens it.
+// Addresses without a scheme are treated as serial port paths.
+var transports = map[string]transportOpener{
+	"serial": openSerialTransport,
+	"udp":    openNetTransport,
+	"tcp":    openNetTransport,
+}
+
+// openTransport opens a device address such as /dev/ttyUSB0,
+// serial:///dev/ttyUSB0, udp://192.168.1.50:8000 or tcp://osr2.local:8000.
+func openTransport(addr string, baud uint) (io.ReadWriteCloser, error) {
+	if !strings.Contains(addr, "://") {
+		return openSerial(addr, baud)
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse device address: %w", err)
+	}
+
+	open, ok := transports[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unknown device scheme %q", u.Scheme)
+	}
+
+	return open(u, baud)
+}
+
+func openSerialTransport(u *url.URL, baud uint) (io.ReadWriteCloser, error) {
+	if u.Path == "" {
+		return nil, errors.New("serial address has no path")
+	}
+
+	return openSerial(u.Path, baud)
+}
+
+func openNetTransport(u *url.URL, _ uint) (io.ReadWriteCloser, error) {
+	if u.Port() == "" {
+		return nil, fmt.Errorf("%s address has no port", u.Scheme)
+	}
+
+	conn, err := net.DialTimeout(u.Scheme, u.Host, dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s: %w", u.Host, err)
+	}
+
+	return conn, nil
+}
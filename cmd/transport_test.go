@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+const testCommand = "L09999I500\n"
+
+func TestOpenTransportUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer pc.Close()
+
+	conn, err := openTransport("udp://"+pc.LocalAddr().String(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(testCommand))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = pc.SetReadDeadline(time.Now().Add(time.Second))
+
+	buf := make([]byte, 64)
+
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(buf[:n]); got != testCommand {
+		t.Fatalf("received %q, want %q", got, testCommand)
+	}
+}
+
+func TestOpenTransportTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	lines := make(chan string, 1)
+	errs := make(chan error, 1)
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			errs <- err
+
+			return
+		}
+
+		defer c.Close()
+
+		_ = c.SetReadDeadline(time.Now().Add(time.Second))
+
+		line, err := bufio.NewReader(c).ReadString('\n')
+		if err != nil {
+			errs <- err
+
+			return
+		}
+
+		lines <- line
+	}()
+
+	conn, err := openTransport("tcp://"+l.Addr().String(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(testCommand))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case line := <-lines:
+		if line != testCommand {
+			t.Fatalf("received %q, want %q", line, testCommand)
+		}
+	case err := <-errs:
+		t.Fatal(err)
+	}
+}
+
+func TestOpenTransportErrors(t *testing.T) {
+	for _, addr := range []string{
+		"ws://127.0.0.1:8000", // unsupported scheme
+		"udp://127.0.0.1",     // no port
+		"tcp://127.0.0.1",
+		"serial://",
+	} {
+		conn, err := openTransport(addr, 0)
+		if err == nil {
+			conn.Close()
+			t.Errorf("openTransport(%q) succeeded, want an error", addr)
+		}
+	}
+}
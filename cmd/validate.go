@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// LintIssue is one problem found in a script. At is the timestamp of the
+// offending action in ms, or -1 if the issue isn't tied to one.
+type LintIssue struct {
+	Path     string   `json:"path"`
+	Axis     string   `json:"axis,omitempty"`
+	At       int      `json:"at"`
+	Severity Severity `json:"severity"`
+	Rule     string   `json:"rule"`
+	Message  string   `json:"message"`
+	Fix      string   `json:"fix"`
+}
+
+func (i LintIssue) String() string {
+	at := "-"
+	if i.At >= 0 {
+		at = (time.Duration(i.At) * time.Millisecond).String()
+	}
+
+	axis := ""
+	if i.Axis != "" {
+		axis = " " + i.Axis
+	}
+
+	return fmt.Sprintf("%s%s: %s [%s] %s: %s (fix: %s)", i.Path, axis, at, i.Severity, i.Rule, i.Message, i.Fix)
+}
+
+// maxLintSpeed is the speed in position units per second above which a
+// device can't keep up. heatmap.go saturates its color scale at about the
+// same speed.
+const maxLintSpeed = 600
+
+// lintScript checks a decoded script and each of its embedded axes.
+func lintScript(script *Script, maxSpeed float64) []LintIssue {
+	issues := []LintIssue{}
+
+	for _, a := range script.Axes {
+		if _, ok := axisID(a.ID); !ok {
+			issues = append(issues, LintIssue{
+				Path:     script.path,
+				Axis:     a.ID,
+				At:       -1,
+				Severity: SeverityError,
+				Rule:     "unknown-axis",
+				Message:  fmt.Sprintf("axis id %q is not a tcode id or axis name", a.ID),
+				Fix:      "use a tcode id such as R0 or an axis name such as twist",
+			})
+		}
+	}
+
+	for _, s := range script.Expand() {
+		issues = append(issues, lintActions(s, maxSpeed)...)
+	}
+
+	return issues
+}
+
+func lintActions(s *Script, maxSpeed float64) []LintIssue {
+	issues := []LintIssue{}
+
+	issue := func(at int, severity Severity, rule, fix, format string, args ...any) {
+		issues = append(issues, LintIssue{
+			Path:     s.path,
+			Axis:     s.name,
+			At:       at,
+			Severity: severity,
+			Rule:     rule,
+			Message:  fmt.Sprintf(format, args...),
+			Fix:      fix,
+		})
+	}
+
+	if len(s.Actions) == 0 {
+		issue(-1, SeverityError, "empty-actions", "add actions or delete the script", "script has no actions")
+
+		return issues
+	}
+
+	times := map[int]bool{}
+	for _, a := range s.Actions {
+		times[a.At] = true
+	}
+
+	if len(times) < 2 {
+		issue(-1, SeverityError, "too-few-actions", "add another action or delete the script",
+			"every action is at %dms, at least 2 distinct times are needed to play", s.Actions[0].At)
+	}
+
+	top := 100
+	if s.Range < 0 {
+		issue(-1, SeverityError, "range", "remove range or set it to 100", "range %d is negative", s.Range)
+	} else if s.Range > 0 {
+		top = s.Range
+	}
+
+	if s.Duration > 0 && s.Duration < s.Actions[len(s.Actions)-1].At {
+		issue(-1, SeverityWarning, "duration", "remove duration or set it to the video length",
+			"duration %dms ends before the last action", s.Duration)
+	}
+
+	for i, a := range s.Actions {
+		if a.At < 0 {
+			issue(a.At, SeverityError, "negative-time", "drop the action or shift the script", "action at %dms is before the start", a.At)
+		}
+
+		if a.Pos < 0 || a.Pos > top {
+			issue(a.At, SeverityError, "position-range", fmt.Sprintf("clamp the position to 0-%d", top),
+				"position %d is outside 0-%d", a.Pos, top)
+		}
+
+		if i == 0 {
+			continue
+		}
+
+		prev := s.Actions[i-1]
+
+		switch {
+		case a.At < prev.At:
+			issue(a.At, SeverityWarning, "unsorted", "sort the actions by time",
+				"action at %dms comes after %dms", a.At, prev.At)
+		case a.At == prev.At:
+			issue(a.At, SeverityWarning, "duplicate-timestamp", "merge or remove one of the actions",
+				"two actions at %dms", a.At)
+		default:
+			if speed := getSpeed(prev, a); speed > maxSpeed {
+				issue(a.At, SeverityWarning, "speed", "slow the stroke down or drop the action",
+					"%.0f units/s is faster than %.0f units/s", speed, maxSpeed)
+			}
+		}
+	}
+
+	return issues
+}
+
+// validate lints a script, or every script in a directory, and reports
+// whether any errors were found.
+func validate(w io.Writer, path string, format string, maxSpeed float64) (bool, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+
+	paths := []string{path}
+
+	if fi.IsDir() {
+		paths, err = filepath.Glob(filepath.Join(path, "*.funscript"))
+		if err != nil {
+			return false, fmt.Errorf("failed to list scripts: %w", err)
+		}
+	}
+
+	issues := []LintIssue{}
+
+	for _, p := range paths {
+		script, err := NewScript(p)
+		if err != nil {
+			issues = append(issues, LintIssue{
+				Path:     p,
+				At:       -1,
+				Severity: SeverityError,
+				Rule:     "decode",
+				Message:  err.Error(),
+				Fix:      "fix the json",
+			})
+
+			continue
+		}
+
+		issues = append(issues, lintScript(script, maxSpeed)...)
+	}
+
+	failed := false
+
+	for _, i := range issues {
+		if i.Severity == SeverityError {
+			failed = true
+		}
+	}
+
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		err = enc.Encode(issues)
+	case "text":
+		lines := make([]string, 0, len(issues)+1)
+		for _, i := range issues {
+			lines = append(lines, i.String())
+		}
+
+		lines = append(lines, fmt.Sprintf("%d scripts, %d issues", len(paths), len(issues)))
+
+		_, err = fmt.Fprintln(w, strings.Join(lines, "\n"))
+	default:
+		err = fmt.Errorf("unknown format %q", format)
+	}
+
+	return failed, err
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// deviceVirtual is the device address of the built-in simulated device.
+const deviceVirtual = "virtual"
+
+// TraceEntry is one command received by the virtual device, along with the
+// position the axis was at when it arrived.
+// Times are in milliseconds since the device was connected.
+type TraceEntry struct {
+	At       int64   `json:"ms"`
+	Axis     string  `json:"axis"`
+	Position float64 `json:"position"`
+	Target   float64 `json:"target"`
+	Interval int64   `json:"interval"`
+}
+
+// virtualAxis is a linear move from `from` to `to` starting at `start`.
+type virtualAxis struct {
+	from, to float64
+	start    time.Time
+	duration time.Duration
+}
+
+func (a virtualAxis) position(now time.Time) float64 {
+	if a.duration <= 0 || now.Sub(a.start) >= a.duration {
+		return a.to
+	}
+
+	if now.Before(a.start) {
+		return a.from
+	}
+
+	t := float64(now.Sub(a.start)) / float64(a.duration)
+
+	return a.from + (a.to-a.from)*t
+}
+
+// virtualDevice is a Device that models axis positions in memory instead of
+// talking to hardware, so playback can run headless.
+type virtualDevice struct {
+	tracePath string
+
+	mu      sync.Mutex
+	state   DeviceState
+	started time.Time
+	axes    map[string]*virtualAxis
+	trace   []TraceEntry
+	replies chan string // closed by Close, Read returns io.EOF once drained
+	closed  bool
+	traced  bool
+}
+
+func newVirtualDevice(tracePath string) *virtualDevice {
+	return &virtualDevice{
+		tracePath: tracePath,
+		axes:      map[string]*virtualAxis{},
+		replies:   make(chan string, 64),
+	}
+}
+
+func (d *virtualDevice) Connect() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.state = DeviceConnected
+	d.started = time.Now()
+
+	if d.closed {
+		d.replies = make(chan string, 64)
+		d.closed = false
+	}
+
+	log.Info().Str("device", deviceVirtual).Msg("opened device")
+
+	return nil
+}
+
+func (d *virtualDevice) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.state != DeviceConnected {
+		return 0, errNotConnected
+	}
+
+	now := time.Now()
+
+	for _, line := range strings.Split(string(p), "\n") {
+		cmds, err := ParseTCode(line)
+		if err != nil {
+			log.Warn().Err(err).Str("tcode", line).Msg("virtual device rejected command")
+
+			continue
+		}
+
+		for _, cmd := range cmds {
+			d.exec(cmd, now)
+		}
+	}
+
+	return len(p), nil
+}
+
+func (d *virtualDevice) exec(cmd Command, now time.Time) {
+	switch cmd := cmd.(type) {
+	case DeviceCommand:
+		d.execDevice(cmd, now)
+	case TCodeMessage:
+		d.execAxis(cmd, now)
+	default:
+		log.Debug().Str("tcode", cmd.String()).Msg("virtual device ignored command")
+	}
+}
+
+func (d *virtualDevice) execDevice(cmd DeviceCommand, now time.Time) {
+	switch cmd {
+	case DeviceName:
+		d.reply(d.info().Name)
+	case DeviceVersion:
+		d.reply(d.info().Version)
+	case DeviceAxes:
+		for _, a := range d.info().Axes {
+			d.reply(fmt.Sprintf("%s%d %d %d %s", a.Axis, a.Channel, a.Min, a.Max, a.Name))
+		}
+	case DeviceStop:
+		for _, a := range d.axes {
+			pos := a.position(now)
+			*a = virtualAxis{from: pos, to: pos, start: now}
+		}
+	}
+}
+
+func (d *virtualDevice) execAxis(msg TCodeMessage, now time.Time) {
+	id := msg.ID()
+
+	a, ok := d.axes[id]
+	if !ok {
+		a = &virtualAxis{from: 0.5, to: 0.5}
+		d.axes[id] = a
+	}
+
+	pos := a.position(now)
+	interval := msg.Duration
+
+	if interval == 0 && msg.Speed > 0 {
+		// speed is in units of 1/10000 of the range per 100ms
+		interval = time.Duration(math.Abs(msg.Value-pos) * 10000 / float64(msg.Speed) * float64(100*time.Millisecond))
+	}
+
+	*a = virtualAxis{from: pos, to: msg.Value, start: now, duration: interval}
+
+	d.trace = append(d.trace, TraceEntry{
+		At:       now.Sub(d.started).Milliseconds(),
+		Axis:     id,
+		Position: pos,
+		Target:   msg.Value,
+		Interval: interval.Milliseconds(),
+	})
+}
+
+// reply queues a response line for Read. d.mu must be held.
+func (d *virtualDevice) reply(line string) {
+	select {
+	case d.replies <- line + "\n":
+	default:
+	}
+}
+
+func (d *virtualDevice) Read(p []byte) (int, error) {
+	d.mu.Lock()
+	replies := d.replies
+	d.mu.Unlock()
+
+	line, ok := <-replies
+	if !ok {
+		return 0, io.EOF
+	}
+
+	return copy(p, line), nil
+}
+
+func (d *virtualDevice) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.state = DeviceDisconnected
+
+	if !d.closed {
+		close(d.replies)
+		d.closed = true
+	}
+
+	if d.tracePath == "" || d.traced {
+		return nil
+	}
+
+	d.traced = true
+
+	err := writeTrace(d.tracePath, d.trace)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Str("trace", d.tracePath).Int("entries", len(d.trace)).Msg("wrote virtual device trace")
+
+	return nil
+}
+
+func (d *virtualDevice) State() DeviceState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.state
+}
+
+// Err is always nil, the virtual device can't fail.
+func (d *virtualDevice) Err() error {
+	return nil
+}
+
+func (d *virtualDevice) Info() DeviceInfo {
+	return d.info()
+}
+
+func (d *virtualDevice) info() DeviceInfo {
+	info := DeviceInfo{
+		Name:    "tcode-player virtual device",
+		Version: "TCode v0.3",
+	}
+
+	names := make([]string, 0, len(axisMap))
+	for name := range axisMap {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		s := axisMap[name]
+		info.Axes = append(info.Axes, DeviceAxis{
+			Axis:    s.Axis,
+			Channel: s.Channel,
+			Min:     0,
+			Max:     9999,
+			Name:    name,
+		})
+	}
+
+	return info
+}
+
+// writeTrace writes the trace as json if path ends in .json, csv otherwise.
+func writeTrace(path string, trace []TraceEntry) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create trace file: %w", err)
+	}
+
+	defer f.Close()
+
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+
+		err = enc.Encode(trace)
+		if err != nil {
+			return fmt.Errorf("failed to encode trace: %w", err)
+		}
+
+		return nil
+	}
+
+	w := csv.NewWriter(f)
+
+	err = w.Write([]string{"ms", "axis", "position", "target", "interval"})
+	if err != nil {
+		return fmt.Errorf("failed to write trace: %w", err)
+	}
+
+	for _, e := range trace {
+		err = w.Write([]string{
+			strconv.FormatInt(e.At, 10),
+			e.Axis,
+			strconv.FormatFloat(e.Position, 'f', 4, 64),
+			strconv.FormatFloat(e.Target, 'f', 4, 64),
+			strconv.FormatInt(e.Interval, 10),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to write trace: %w", err)
+		}
+	}
+
+	w.Flush()
+
+	return w.Error()
+}
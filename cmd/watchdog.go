@@ -0,0 +1,107 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// defaultWatchdog is how long in ms playback goes on without a seek or
+// heartbeat from the host. The plugin seeks many times a second while a
+// video plays.
+const defaultWatchdog = 3000
+
+// Watchdog halts playback when the host stops reporting in, so a crashed
+// player or a dead plugin timer doesn't leave the device running from the
+// last position forever. It only watches while armed, between play and
+// pause, and halts the playback it was armed with.
+type Watchdog struct {
+	mu sync.Mutex
+
+	halt  func(*TCode)
+	tcode *TCode
+	timer *time.Timer
+	gen   int // bumped on every feed so a stale timer can tell
+
+	armed  bool
+	halted bool
+}
+
+func NewWatchdog(halt func(*TCode)) *Watchdog {
+	return &Watchdog{halt: halt}
+}
+
+// Arm starts watching t, when playback starts.
+func (w *Watchdog) Arm(t *TCode) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.tcode = t
+	w.armed, w.halted = true, false
+	w.reset()
+}
+
+// Disarm stops watching, when playback is paused or stopped.
+func (w *Watchdog) Disarm() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.tcode = nil
+	w.armed, w.halted = false, false
+	w.gen++
+
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
+
+// Feed tells the watchdog the host is alive. It reports whether the
+// watchdog had halted playback, which the caller then resumes.
+func (w *Watchdog) Feed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.armed {
+		return false
+	}
+
+	halted := w.halted
+	w.halted = false
+	w.reset()
+
+	return halted
+}
+
+// reset restarts the timer, the caller holds mu.
+func (w *Watchdog) reset() {
+	w.gen++
+
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+
+	timeout := time.Duration(params.Load().Watchdog) * time.Millisecond
+	if timeout <= 0 {
+		return
+	}
+
+	gen := w.gen
+	w.timer = time.AfterFunc(timeout, func() {
+		w.mu.Lock()
+
+		if gen != w.gen || !w.armed || w.halted {
+			w.mu.Unlock()
+
+			return
+		}
+
+		w.halted = true
+		t := w.tcode
+		w.mu.Unlock()
+
+		log.Warn().Dur("timeout", timeout).Msg("no word from the host, halting playback")
+
+		w.halt(t)
+	})
+}
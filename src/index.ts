@@ -160,5 +160,7 @@ setInterval(() => {
     `${preferences.get("preferSoft") ? "true" : "false"}`,
     `preferHard`,
     `${preferences.get("preferHard") ? "true" : "false"}`,
+    `rate`,
+    `${core.status.speed || 1}`,
   ]);
 }, 2000);
\ No newline at end of file